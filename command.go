@@ -0,0 +1,263 @@
+// Copyright 2017 Javier Arevalo <jare@iguanademos.com>
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+// http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Running command lines with placeholders for the files in the panels,
+// capturing their output
+
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+
+	"github.com/nsf/termbox-go"
+)
+
+// commandVars returns the values of the placeholders of command lines:
+// %f the file at the cursor, %F the selected files (or the one at the
+// cursor), %d the folder of the active panel, %D the folder of the other
+// panel and %s the files selected in the other panel
+func commandVars() map[byte][]string {
+	vars := map[byte][]string{
+		'f': nil,
+		'F': nil,
+		'd': {ap.Cwd},
+		'D': {op.Cwd},
+		's': nil,
+	}
+	// Commands run in the active panel's folder, so names are enough
+	if ap.Cursor < len(ap.Entries) {
+		vars['f'] = []string{ap.Entries[ap.Cursor].Name()}
+	}
+	for _, e := range selectedEntries() {
+		vars['F'] = append(vars['F'], e.Name())
+	}
+	for _, e := range op.Entries {
+		if op.Selected[e.Name()] {
+			vars['s'] = append(vars['s'], op.Path(e))
+		}
+	}
+	return vars
+}
+
+// expandCommandLine replaces the placeholders of a command line with
+// their values, quoted for the shell
+func expandCommandLine(command string, vars map[byte][]string) string {
+	return expandPlaceholders(command, func(c byte) (string, bool) {
+		values, ok := vars[c]
+		quoted := make([]string, len(values))
+		for i, v := range values {
+			quoted[i] = ShellQuote(v)
+		}
+		return strings.Join(quoted, " "), ok
+	})
+}
+
+// ------------------
+
+// commandRun is a command line running in the background, with its
+// output and errors gathered as they come
+type commandRun struct {
+	Command string
+	Dir     string
+	cancel  context.CancelFunc
+	mu      sync.Mutex
+	lines   []textLine
+	done    bool
+	err     error
+}
+
+func startCommand(command string, dir string) *commandRun {
+	r := &commandRun{Command: command, Dir: dir}
+	ctx, cancel := context.WithCancel(context.Background())
+	r.cancel = cancel
+	cmd := ShellCommand(command)
+	cmd.Dir = dir
+	// Cancelling kills the programs started by the shell too, which
+	// would keep the output open
+	SetProcessGroup(cmd)
+	out, err := cmd.StdoutPipe()
+	if err == nil {
+		// The same writer for both keeps their lines in order
+		cmd.Stderr = cmd.Stdout
+		err = cmd.Start()
+	}
+	if err != nil {
+		r.finish(err)
+		return r
+	}
+	// Only kill while the command runs; once it's waited for, its pid
+	// may belong to another process
+	done := make(chan struct{})
+	go func() {
+		select {
+		case <-ctx.Done():
+			KillProcessGroup(cmd)
+		case <-done:
+		}
+	}()
+	go func() {
+		r.read(out)
+		err := cmd.Wait()
+		close(done)
+		r.finish(err)
+		cancel()
+	}()
+	return r
+}
+
+func (r *commandRun) read(out io.Reader) {
+	br := bufio.NewReader(out)
+	for {
+		line, err := br.ReadString('\n')
+		if line != "" {
+			r.mu.Lock()
+			r.lines = append(r.lines, textLine{strings.TrimRight(line, "\r\n"), termbox.ColorDefault})
+			r.mu.Unlock()
+			notifyUI()
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+// finish records how the command ended, and adds its output to the
+// messages
+func (r *commandRun) finish(err error) {
+	r.mu.Lock()
+	r.done, r.err = true, err
+	lines := make([]string, len(r.lines))
+	for i, l := range r.lines {
+		lines[i] = l.Text
+	}
+	r.mu.Unlock()
+	title := "$ " + r.Command
+	if err != nil {
+		title += " [" + err.Error() + "]"
+	}
+	messages.Add(title, lines, err != nil)
+	notifyUI()
+}
+
+// Lines returns the output so far. Lines are only added at the end, so
+// the slice returned stays valid
+func (r *commandRun) Lines() []textLine {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.lines
+}
+
+// Running returns whether the command is still running
+func (r *commandRun) Running() bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return !r.done
+}
+
+// Cancel kills the command
+func (r *commandRun) Cancel() {
+	r.cancel()
+}
+
+// Err returns the error the command ended with, if any
+func (r *commandRun) Err() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.err
+}
+
+// Result describes how the command ended
+func (r *commandRun) Result() string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	switch {
+	case !r.done:
+		return "running..."
+	case r.err != nil:
+		return r.err.Error()
+	}
+	return "done"
+}
+
+// ------------------
+
+// lastCommand is the last command line run from the prompt
+var lastCommand string
+
+// startCommandPrompt asks for a command line to run in the folder of
+// the active panel, and shows its output
+func startCommandPrompt() {
+	if !requireFolder(ap) {
+		return
+	}
+	title := "Run (%f file, %F selected, %d folder, %D other folder, %s other selected)"
+	pushView(newPromptView(title, lastCommand, func(text string) bool {
+		if strings.TrimSpace(text) == "" {
+			return true
+		}
+		lastCommand = text
+		command := expandCommandLine(text, commandVars())
+		pushView(&outputView{run: startCommand(command, ap.Cwd), text: newScrollText(true)})
+		return true
+	}))
+}
+
+// outputView shows the output of a command as it runs
+type outputView struct {
+	run  *commandRun
+	text *scrollText
+}
+
+func (v *outputView) Render(w, h int) {
+	lines := v.run.Lines()
+	v.text.SetLines(lines)
+	v.text.Render(fmt.Sprintf("$ %s [%s]", v.run.Command, v.run.Result()), w, h)
+	if !v.run.Running() && len(lines) == 0 {
+		tbprint(0, 1, termbox.ColorCyan, termbox.ColorDefault, "(no output)")
+	}
+}
+
+func (v *outputView) RenderStatus(y, w int) {
+	v.text.RenderStatus(y, w, v.Help())
+}
+
+func (v *outputView) HandleKey(ev termbox.Event) bool {
+	v.text.SetLines(v.run.Lines())
+	if v.text.HandleKey(ev) {
+		return true
+	} else if ev.Key == termbox.KeyEsc && v.run.Running() {
+		v.run.Cancel()
+		return true
+	} else if ev.Key == termbox.KeyEsc || ev.Ch == 'q' || ev.Key == termbox.KeyEnter {
+		// Closing stops a command still running, so it doesn't go on
+		// unseen
+		v.run.Cancel()
+		ap.Refresh()
+		op.Refresh()
+		return false
+	}
+	return true
+}
+
+func (v *outputView) Help() string {
+	if v.run.Running() {
+		return "[ESC stop] [q,ENTER stop and close] [ARROWS scroll] [/ Search] [n/N Next/previous match]"
+	}
+	return "[ESC,q,ENTER close] [ARROWS scroll] [/ Search] [n/N Next/previous match]"
+}
@@ -0,0 +1,141 @@
+// Copyright 2017 Javier Arevalo <jare@iguanademos.com>
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+// http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"reflect"
+	"runtime"
+	"strings"
+	"testing"
+)
+
+// Names that a shell would split, expand or run if they weren't quoted
+var trickyNames = []string{
+	"plain.txt",
+	"with space",
+	"  leading and trailing  ",
+	"it's",
+	"'",
+	"''quoted''",
+	`"double"`,
+	"$HOME",
+	"${PATH}",
+	"`id`",
+	"$(id)",
+	"two\nlines",
+	"tab\there",
+	"*",
+	"?.go",
+	"[a]",
+	"-n",
+	"semi;colon",
+	"a&b|c>d<e",
+	`back\slash`,
+	"~root",
+	"#hash",
+	"100%",
+	"日本語",
+}
+
+func TestShellQuote(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("POSIX quoting")
+	}
+	tests := []struct {
+		s, want string
+	}{
+		{"plain.txt", "plain.txt"},
+		{"a-b_c+d=e,f/g:h@i%j", "a-b_c+d=e,f/g:h@i%j"},
+		{"", "''"},
+		{"with space", "'with space'"},
+		{"it's", `'it'\''s'`},
+		{"$HOME", "'$HOME'"},
+		{"`id`", "'`id`'"},
+		{"two\nlines", "'two\nlines'"},
+		{"日本語", "'日本語'"},
+	}
+	for _, tt := range tests {
+		if got := ShellQuote(tt.s); got != tt.want {
+			t.Errorf("%q: got %s, want %s", tt.s, got, tt.want)
+		}
+	}
+}
+
+// TestShellQuoteRoundTrip checks that the shell sees each quoted name
+// as one argument, exactly as it was
+func TestShellQuoteRoundTrip(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("POSIX quoting")
+	}
+	for _, name := range append(trickyNames, "") {
+		line := "printf %s " + ShellQuote(name)
+		out, err := ShellCommand(line).Output()
+		if err != nil {
+			t.Errorf("%q: %s failed: %s", name, line, err)
+			continue
+		}
+		if string(out) != name {
+			t.Errorf("%q: the shell got %q", name, out)
+		}
+		words, err := splitCommandLine(ShellQuote(name))
+		if err != nil || !reflect.DeepEqual(words, []string{name}) {
+			t.Errorf("%q: splitCommandLine got %q, %v", name, words, err)
+		}
+	}
+}
+
+func TestExpandCommandLine(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("POSIX quoting")
+	}
+	vars := map[byte][]string{
+		'f': {"it's"},
+		'F': {"a b", "$x"},
+		'd': {"/tmp"},
+		's': nil,
+	}
+	tests := []struct {
+		command, want string
+	}{
+		{"vim %f", `vim 'it'\''s'`},
+		{"tar czf x.tgz %F", "tar czf x.tgz 'a b' '$x'"},
+		{"cd %d && ls", "cd /tmp && ls"},
+		{"echo %s.", "echo ."},
+		{"printf '%%s' %z", "printf '%s' %z"},
+	}
+	for _, tt := range tests {
+		if got := expandCommandLine(tt.command, vars); got != tt.want {
+			t.Errorf("%q: got %s, want %s", tt.command, got, tt.want)
+		}
+	}
+}
+
+// TestExpandCommandLineRoundTrip checks that the files given to a
+// command line reach the program as one argument each
+func TestExpandCommandLineRoundTrip(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("POSIX quoting")
+	}
+	vars := map[byte][]string{'F': trickyNames}
+	line := expandCommandLine(`printf '%%s\0' %F`, vars)
+	out, err := ShellCommand(line).Output()
+	if err != nil {
+		t.Fatalf("%s failed: %s", line, err)
+	}
+	got := strings.Split(strings.TrimSuffix(string(out), "\x00"), "\x00")
+	if !reflect.DeepEqual(got, trickyNames) {
+		t.Errorf("the shell got %q, want %q", got, trickyNames)
+	}
+}
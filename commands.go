@@ -17,22 +17,24 @@
 package main
 
 import (
-	"bufio"
+	"context"
+	"errors"
 	"fmt"
+	"io"
+	"io/ioutil"
 	"os"
 	"os/exec"
 	"path/filepath"
 	"runtime"
-	"strconv"
 	"strings"
+	"time"
 )
 
 // RunShell runs an interactive shell.
 // Since the current program is still running, so may be
-// its coroutines, which will trigger all sorts of weirdness
-// For example, Ctrl-C may be caught by our Go runtime, killing us
-// but leaving the spawned shell still running, with I/O shared with
-// our parent (possibly another shell!). That's pretty ugly.
+// its coroutines. It must be called through runSuspended, which
+// keeps Ctrl-C in the shell from killing us and leaving the shell
+// running with I/O shared with our parent (possibly another shell!)
 func RunShell(cwd string) error {
 	attr := os.ProcAttr{
 		Files: []*os.File{os.Stdin, os.Stdout, os.Stderr},
@@ -61,148 +63,688 @@ func RunShell(cwd string) error {
 	return fmt.Errorf("<< Exited shell: %s", state.String())
 }
 
-// RunCommand executes the given command and arguments under the system'
-// default shell. Really only tested under CMD and ksh
-// If command fails, returns the system error and the output of the command
-func RunCommand(command string, args ...string) error {
-	var ret []string
-	var finalargs []string
-	var shell string
+// EditorCommand returns the user's preferred text editor
+// and its arguments, from $VISUAL or $EDITOR
+func EditorCommand() []string {
+	for _, v := range []string{"VISUAL", "EDITOR"} {
+		if args := strings.Fields(os.Getenv(v)); len(args) > 0 {
+			return args
+		}
+	}
+	if runtime.GOOS == "windows" {
+		return []string{"notepad"}
+	}
+	return []string{"vi"}
+}
+
+// PagerCommand returns the user's preferred pager and its arguments,
+// from $PAGER
+func PagerCommand() []string {
+	if args := strings.Fields(os.Getenv("PAGER")); len(args) > 0 {
+		return args
+	}
+	if _, err := exec.LookPath("less"); err == nil {
+		return []string{"less"}
+	}
+	return []string{"more"}
+}
+
+// RunEditor opens a file in the user's text editor and waits for it
+// to exit. The terminal must not be in use while it runs
+func RunEditor(file string) error {
+	return runWithFile(EditorCommand(), file)
+}
+
+// RunPager shows a file in the user's pager and waits for it to exit.
+// The terminal must not be in use while it runs
+func RunPager(file string) error {
+	return runWithFile(PagerCommand(), file)
+}
+
+func runWithFile(args []string, file string) error {
+	cmd := exec.Command(args[0], append(args[1:], file)...)
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = os.Stdin, os.Stdout, os.Stderr
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("Running %s failed: %s", args[0], err)
+	}
+	return nil
+}
+
+// ShellCommand prepares a command line to run with /bin/sh, whose
+// quoting ShellQuote follows, or with CMD on Windows
+func ShellCommand(command string) *exec.Cmd {
 	if runtime.GOOS == "windows" {
-		sh, ok := os.LookupEnv("COMSPEC")
+		shell, ok := os.LookupEnv("COMSPEC")
 		if !ok {
 			shell = "C:\\Windows\\System32\\cmd.exe"
 		}
-		shell = sh
-		args = append([]string{command}, args...)
-		finalargs = []string{"/C", strings.Join(args, " ") + " 2>&1"}
-	} else {
-		sh, ok := os.LookupEnv("SHELL")
-		if !ok {
-			shell = "/bin/sh"
+		args := []string{"/C", command}
+		cmd := exec.Command(shell, args...)
+		// See comment in sys_windows.go for this
+		SetProcCmdline(cmd, strings.Join(args, " "))
+		return cmd
+	}
+	return exec.Command("/bin/sh", "-c", command)
+}
+
+// ShellQuote quotes s to be a single argument in a command line run by
+// ShellCommand. CMD has no way to quote %, so %VAR% in names is expanded
+func ShellQuote(s string) string {
+	if runtime.GOOS == "windows" {
+		if s != "" && !strings.ContainsAny(s, " \t\"&|<>^()%!,;=") {
+			return s
 		}
-		shell = sh
-		for i, v := range args {
-			args[i] = strconv.Quote(v)
+		return `"` + strings.Replace(s, `"`, `""`, -1) + `"`
+	}
+	if s != "" && strings.Trim(s, "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789_-+=.,/:@%") == "" {
+		return s
+	}
+	return "'" + strings.Replace(s, "'", `'\''`, -1) + "'"
+}
+
+// FileError records the failure of an operation on a single file
+// inside a larger (possibly recursive) operation
+type FileError struct {
+	Op   string
+	Path string
+	Err  error
+}
+
+func (e *FileError) Error() string {
+	return e.Op + " " + e.Path + ": " + e.Err.Error()
+}
+
+// FileErrors collects all the per-file errors of an operation
+type FileErrors []*FileError
+
+func (e FileErrors) Error() string {
+	s := make([]string, len(e))
+	for i, fe := range e {
+		s[i] = fe.Error()
+	}
+	return strings.Join(s, "; ")
+}
+
+// ErrCancelled is returned by file operations stopped by their context
+var ErrCancelled = errors.New("Cancelled")
+
+// ConflictAction is what to do when the target of a copy or move exists
+type ConflictAction int
+
+const (
+	ConflictSkip ConflictAction = iota
+	ConflictOverwrite
+	ConflictOverwriteNewer
+	ConflictRename
+)
+
+// OpCallbacks lets the caller of a file operation follow its progress
+// and decide about existing files.
+// A nil *OpCallbacks, or any nil callback in it, is allowed
+type OpCallbacks struct {
+	// Progress is called with n = 0 when a file starts being copied,
+	// and then with the number of bytes written as the copy advances
+	Progress func(file string, n int64)
+	// Conflict is called when the target dst of src already exists.
+	// Without it, existing files are overwritten
+	Conflict func(src string, dst string, srcInfo os.FileInfo, dstInfo os.FileInfo) ConflictAction
+	// Created is called when src was fully copied or moved to dst, and
+	// dst didn't exist before, so the operation can be undone
+	Created func(src string, dst string)
+	// Overwritten is called when the existing file dst is replaced,
+	// which can't be undone
+	Overwritten func(dst string)
+}
+
+func (cb *OpCallbacks) progress(file string, n int64) {
+	if cb != nil && cb.Progress != nil {
+		cb.Progress(file, n)
+	}
+}
+
+func (cb *OpCallbacks) created(src string, dst string) {
+	if cb != nil && cb.Created != nil {
+		cb.Created(src, dst)
+	}
+}
+
+func (cb *OpCallbacks) overwritten(dst string) {
+	if cb != nil && cb.Overwritten != nil {
+		cb.Overwritten(dst)
+	}
+}
+
+func (cb *OpCallbacks) conflict(src string, dst string, srcInfo os.FileInfo, dstInfo os.FileInfo) ConflictAction {
+	if cb != nil && cb.Conflict != nil {
+		return cb.Conflict(src, dst, srcInfo, dstInfo)
+	}
+	return ConflictOverwrite
+}
+
+// progressWriter reports the bytes written through it, and stops
+// writing when its context is cancelled
+type progressWriter struct {
+	ctx  context.Context
+	w    io.Writer
+	file string
+	cb   *OpCallbacks
+}
+
+func (pw *progressWriter) Write(b []byte) (int, error) {
+	if pw.ctx.Err() != nil {
+		return 0, ErrCancelled
+	}
+	n, err := pw.w.Write(b)
+	pw.cb.progress(pw.file, int64(n))
+	return n, err
+}
+
+// copier performs a recursive copy, collecting an error for each
+// file that can't be copied instead of stopping at the first one
+type copier struct {
+	ctx  context.Context
+	cb   *OpCallbacks
+	errs FileErrors
+	// Entries fully copied, in the order they were finished
+	copied []copiedEntry
+	// Folders created, which get their final mode from setDirModes
+	// once their contents are in place, in case they're read only
+	dirs []copiedEntry
+}
+
+type copiedEntry struct {
+	src, dst string
+	info     os.FileInfo
+}
+
+func (c *copier) fail(op string, path string, err error) {
+	c.errs = append(c.errs, &FileError{Op: op, Path: path, Err: err})
+}
+
+func (c *copier) done(src string, dst string, info os.FileInfo) {
+	c.copied = append(c.copied, copiedEntry{src, dst, info})
+}
+
+// err returns the collected errors, or nil if there were none. If
+// it was cancelled it returns ErrCancelled, unless there were errors
+// before, which are returned so they're not lost
+func (c *copier) err() error {
+	if len(c.errs) > 0 {
+		return c.errs
+	}
+	if c.ctx.Err() != nil {
+		return ErrCancelled
+	}
+	return nil
+}
+
+// setDirModes gives the folders created their final mode
+func (c *copier) setDirModes() {
+	for _, e := range c.dirs {
+		if err := os.Chmod(e.dst, preservedMode(e.info.Mode())); err != nil {
+			c.fail("chmod", e.dst, err)
 		}
-		args = append([]string{command}, args...)
-		finalargs = []string{"-c", strings.Join(args, " ") + " 2>&1"}
 	}
-	Logf("Running command:\n>%s<\n>>%s<<\n", shell, strings.Join(finalargs, "<<\n>>"))
-	cmd := exec.Command(shell, finalargs...)
+}
 
-	// See comment in sys_windows.go for this
-	SetProcCmdline(cmd, strings.Join(finalargs, " "))
+// removeCopied removes the entries copied so far. Folders are removed
+// after their contents, and only if they ended up empty
+func (c *copier) removeCopied() {
+	for _, e := range c.copied {
+		os.Remove(e.dst)
+	}
+}
 
-	outp, err := cmd.StdoutPipe()
+// resolve checks if dst already exists and if so, asks what to do
+// about it. Returns the path to write to, or "" to skip this entry
+func (c *copier) resolve(src string, dst string, info os.FileInfo) string {
+	dstInfo, err := os.Lstat(dst)
 	if err != nil {
-		return fmt.Errorf("Failed to attach stdout: %v", err)
+		return dst
+	}
+	switch c.cb.conflict(src, dst, info, dstInfo) {
+	case ConflictOverwrite:
+	case ConflictOverwriteNewer:
+		if !info.ModTime().After(dstInfo.ModTime()) {
+			return ""
+		}
+	case ConflictRename:
+		return uniqueName(dst, info.IsDir())
+	default:
+		return ""
+	}
+	// Folders are never replaced, only merged into
+	if dstInfo.IsDir() {
+		c.fail("overwrite", dst, fmt.Errorf("target is an existing folder"))
+		return ""
+	}
+	err = os.Remove(dst)
+	if os.IsPermission(err) {
+		// Overwriting a read only file, like xcopy /R did
+		if os.Chmod(dst, 0600) == nil {
+			err = os.Remove(dst)
+		}
 	}
-	err = cmd.Start()
 	if err != nil {
-		Logf("ERROR: %s: %s\n", err, strings.Join(ret, "\n"))
-		return fmt.Errorf("%s -> %s: %s", strings.Join(finalargs[1:], " "), err, strings.Join(ret, " \n"))
+		c.fail("overwrite", dst, err)
+		return ""
 	}
-	scanner := bufio.NewScanner(outp)
-	for scanner.Scan() {
-		line := scanner.Text()
-		ret = append(ret, line)
+	c.cb.overwritten(dst)
+	return dst
+}
+
+// copyReported copies src to the full path dst like copyEntry, and
+// reports it as created if it all went well. Entries merged into an
+// existing folder or overwriting a file are not, since that can't be
+// undone; the entries copied into the folder are reported instead
+func (c *copier) copyReported(src string, dst string) {
+	_, err := os.Lstat(dst)
+	existed := err == nil
+	n := len(c.errs)
+	final := c.copyEntry(src, dst)
+	if final != "" && len(c.errs) == n && c.ctx.Err() == nil && (!existed || final != dst) {
+		c.cb.created(src, final)
 	}
-	err = cmd.Wait()
-	Logf("Output: %s\n", strings.Join(ret, "\n"))
+}
+
+// copyEntry copies src (file, folder or symlink) to the full path dst.
+// Returns the path finally copied to, or "" if it was skipped
+func (c *copier) copyEntry(src string, dst string) string {
+	if c.ctx.Err() != nil {
+		return ""
+	}
+	info, err := os.Lstat(src)
 	if err != nil {
-		Logf("ERROR: %s: %s\n", err, strings.Join(ret, "\n"))
-		return fmt.Errorf("%s -> %s: %s", strings.Join(finalargs[1:], " "), err, strings.Join(ret, " \n"))
+		c.fail("copy", src, err)
+		return ""
 	}
-	return nil
+	mode := info.Mode()
+	if !mode.IsDir() || !isDir(dst) {
+		// Existing folders are merged without asking
+		if dst = c.resolve(src, dst, info); dst == "" {
+			return ""
+		}
+	}
+	switch {
+	case mode&os.ModeSymlink != 0:
+		c.copySymlink(src, dst, info)
+	case mode.IsDir():
+		c.copyDir(src, dst, info)
+	case mode.IsRegular():
+		c.copyFile(src, dst, info)
+	default:
+		// Devices, pipes and sockets can't be meaningfully copied
+		c.fail("copy", src, fmt.Errorf("unsupported file type (%s)", fileTypeName(mode)))
+	}
+	return dst
 }
 
-func quoteString(src string) string {
-	if l := len(src); l > 2 && src[0] != '"' && src[l-1] != '"' {
-		return "\"" + src + "\""
+func (c *copier) copySymlink(src string, dst string, info os.FileInfo) {
+	link, err := os.Readlink(src)
+	if err != nil {
+		c.fail("readlink", src, err)
+		return
+	}
+	if err = os.Symlink(link, dst); err != nil {
+		c.fail("symlink", dst, err)
+		return
 	}
-	return src
+	c.done(src, dst, info)
+}
+
+func (c *copier) copyDir(src string, dst string, info os.FileInfo) {
+	created := false
+	if !isDir(dst) {
+		if err := os.Mkdir(dst, 0700); err != nil {
+			c.fail("mkdir", dst, err)
+			return
+		}
+		created = true
+	}
+	entries, err := ioutil.ReadDir(src)
+	if err != nil {
+		c.fail("readdir", src, err)
+	}
+	for _, e := range entries {
+		if created {
+			c.copyEntry(filepath.Join(src, e.Name()), filepath.Join(dst, e.Name()))
+		} else {
+			c.copyReported(filepath.Join(src, e.Name()), filepath.Join(dst, e.Name()))
+		}
+	}
+	// The mode is set later by setDirModes, and the times last,
+	// because creating the contents changes them
+	if created {
+		c.dirs = append(c.dirs, copiedEntry{src, dst, info})
+	}
+	if err = os.Chtimes(dst, info.ModTime(), info.ModTime()); err != nil {
+		c.fail("chtimes", dst, err)
+	}
+	c.done(src, dst, info)
+}
+
+func (c *copier) copyFile(src string, dst string, info os.FileInfo) {
+	in, err := os.Open(src)
+	if err != nil {
+		c.fail("open", src, err)
+		return
+	}
+	defer in.Close()
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		c.fail("create", dst, err)
+		return
+	}
+	c.cb.progress(src, 0)
+	_, err = io.CopyBuffer(&progressWriter{c.ctx, out, src, c.cb}, in, make([]byte, 256*1024))
+	if cerr := out.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		if err = os.Chmod(dst, preservedMode(info.Mode())); err != nil {
+			c.fail("chmod", dst, err)
+		} else if err = os.Chtimes(dst, info.ModTime(), info.ModTime()); err != nil {
+			c.fail("chtimes", dst, err)
+		}
+	} else if err != ErrCancelled {
+		c.fail("copy", src, err)
+	}
+	if err != nil {
+		// Don't leave a partial file behind
+		os.Remove(dst)
+		return
+	}
+	c.done(src, dst, info)
+}
+
+func isDir(path string) bool {
+	st, err := os.Lstat(path)
+	return err == nil && st.IsDir()
+}
+
+// uniqueName returns a path that doesn't exist yet, by adding a
+// counter to the name: "file.txt" becomes "file (1).txt". Folders and
+// names starting with a dot, like ".bashrc", get it at the end
+func uniqueName(path string, isDir bool) string {
+	ext := filepath.Ext(path)
+	if isDir || strings.HasPrefix(filepath.Base(path), ".") {
+		ext = ""
+	}
+	base := strings.TrimSuffix(path, ext)
+	for i := 1; ; i++ {
+		name := fmt.Sprintf("%s (%d)%s", base, i, ext)
+		if _, err := os.Lstat(name); os.IsNotExist(err) {
+			return name
+		}
+	}
+}
+
+// fileTypeName describes the type of the special files we don't copy
+func fileTypeName(mode os.FileMode) string {
+	switch {
+	case mode&os.ModeNamedPipe != 0:
+		return "named pipe"
+	case mode&os.ModeSocket != 0:
+		return "socket"
+	case mode&os.ModeCharDevice != 0:
+		return "character device"
+	case mode&os.ModeDevice != 0:
+		return "device"
+	}
+	return "irregular file"
+}
+
+// preservedMode returns the bits of mode that a copy should keep
+func preservedMode(mode os.FileMode) os.FileMode {
+	return mode & (os.ModePerm | os.ModeSetuid | os.ModeSetgid | os.ModeSticky)
+}
+
+// isInside returns true if path is dir or something inside it
+func isInside(path string, dir string) bool {
+	if runtime.GOOS == "windows" {
+		path, dir = strings.ToLower(path), strings.ToLower(dir)
+	}
+	return path == dir || strings.HasPrefix(path, dir+string(os.PathSeparator))
 }
 
 // CommandCopy copies a given file or folder into the target folder
 // Does not verify that the target folder exists nor if
 // it is in fact a folder
 // Fails if the target is the root folder
-// If command fails, returns the system error and the output of the command
-func CommandCopy(src string, dst string) error {
+// Mode bits, modification times and symlinks are preserved. Existing
+// folders are merged. Existing files are handled as cb's Conflict
+// decides, and overwritten by default.
+// If some files fail to copy, the rest are still copied and a FileErrors
+// with the failures is returned. Files that fail halfway are removed
+// Cancelling ctx stops the copy in the middle of the current file, which
+// is removed, and returns ErrCancelled, or the errors found until then
+func CommandCopy(ctx context.Context, src string, dst string, cb *OpCallbacks) error {
+	src = filepath.Clean(src)
 	dst = filepath.Clean(dst)
 	if dst[len(dst)-1] == os.PathSeparator {
 		return fmt.Errorf("Copy to root folder %s not allowed for safety", dst)
 	}
-	dst += string(os.PathSeparator)
-	// Many safety checks to perform here...
-	if runtime.GOOS == "windows" {
-		// We end up using xcopy because copy will NOT handle hidden files ever
-		stat, err := os.Stat(src)
+	target := filepath.Join(dst, filepath.Base(src))
+	if isInside(target, src) {
+		return fmt.Errorf("Can't copy %s into itself", src)
+	}
+	c := copier{ctx: ctx, cb: cb}
+	c.copyReported(src, target)
+	c.setDirModes()
+	return c.err()
+}
+
+// mover moves files by renaming them, merging folders that already
+// exist, and falling back to copying across file systems
+type mover struct {
+	copier
+}
+
+// moveEntry moves src to the full path dst. Returns the path finally
+// moved to, or "" if it was skipped or merged into an existing folder
+func (m *mover) moveEntry(src string, dst string) string {
+	if m.ctx.Err() != nil {
+		return ""
+	}
+	info, err := os.Lstat(src)
+	if err != nil {
+		m.fail("move", src, err)
+		return ""
+	}
+	if info.IsDir() && isDir(dst) {
+		// Merge the contents, and remove the source folder if
+		// it ended up empty
+		entries, err := ioutil.ReadDir(src)
 		if err != nil {
-			return err
+			m.fail("readdir", src, err)
+			return ""
 		}
-		if stat.IsDir() {
-			fullDest := filepath.Join(dst, filepath.Base(src))
-			return RunCommand("xcopy", "/Q", "/I", "/K", "/H", "/Y", "/R", "/S", "/E", quoteString(src), quoteString(fullDest))
+		for _, e := range entries {
+			m.moveReported(filepath.Join(src, e.Name()), filepath.Join(dst, e.Name()))
 		}
-		return RunCommand("xcopy", "/Q", "/K", "/H", "/Y", "/R", quoteString(src), quoteString(dst))
+		os.Remove(src)
+		return ""
+	}
+	if dst = m.resolve(src, dst, info); dst == "" {
+		return ""
+	}
+	err = os.Rename(src, dst)
+	if err == nil {
+		return dst
+	}
+	if !IsCrossDevice(err) {
+		m.fail("move", src, err)
+		return ""
+	}
+	Logf("Moving %s across devices via copy\n", src)
+	if !m.moveByCopy(src, dst) {
+		return ""
 	}
-	return RunCommand("cp", "-R", src, dst)
+	return dst
+}
+
+// moveReported moves src to the full path dst like moveEntry, and
+// reports it as created like copyReported does
+func (m *mover) moveReported(src string, dst string) {
+	_, err := os.Lstat(dst)
+	existed := err == nil
+	n := len(m.errs)
+	final := m.moveEntry(src, dst)
+	if final != "" && len(m.errs) == n && m.ctx.Err() == nil && (!existed || final != dst) {
+		m.cb.created(src, final)
+	}
+}
+
+// moveByCopy copies src and removes it only after the whole copy
+// succeeded and was verified. Returns true if all that succeeded.
+// Otherwise the copy is removed, so there are no duplicates left
+func (m *mover) moveByCopy(src string, dst string) bool {
+	c := copier{ctx: m.ctx, cb: m.cb}
+	c.copyEntry(src, dst)
+	if c.err() != nil {
+		m.errs = append(m.errs, c.errs...)
+		c.removeCopied()
+		return false
+	}
+	verified := true
+	for _, e := range c.copied {
+		if err := verifyCopy(e); err != nil {
+			m.fail("verify", e.dst, err)
+			verified = false
+		}
+	}
+	if !verified {
+		c.removeCopied()
+		return false
+	}
+	c.setDirModes()
+	m.errs = append(m.errs, c.errs...)
+	// Entries are in the order they finished, so folders come after
+	// their contents. Folders with skipped files in them are kept
+	for _, e := range c.copied {
+		if e.info.IsDir() {
+			os.Remove(e.src)
+		} else if err := os.Remove(e.src); err != nil {
+			m.fail("remove", e.src, err)
+		}
+	}
+	_, err := os.Lstat(src)
+	return os.IsNotExist(err)
+}
+
+// verifyCopy checks that a copied entry has the same type as its
+// source and, for regular files, the same size
+func verifyCopy(e copiedEntry) error {
+	st, err := os.Lstat(e.dst)
+	if err != nil {
+		return err
+	}
+	if st.Mode().Type() != e.info.Mode().Type() {
+		return fmt.Errorf("file type differs from source")
+	}
+	if e.info.Mode().IsRegular() && st.Size() != e.info.Size() {
+		return fmt.Errorf("size %d differs from source size %d", st.Size(), e.info.Size())
+	}
+	return nil
 }
 
 // CommandMove moves a given file or folder into the target folder
 // Does not verify that the target folder exists nor if
 // it is in fact a folder
 // Fails if the target is the root folder
-// If command fails, returns the system error and the output of the command
-func CommandMove(src string, dst string) error {
+// Moves are done by renaming when possible. Across file systems the
+// source is copied and verified, and only removed if all that succeeded.
+// Existing files are handled as in CommandCopy
+// Cancelling ctx stops a copy like in CommandCopy, leaving the source intact
+// and removing what was copied
+func CommandMove(ctx context.Context, src string, dst string, cb *OpCallbacks) error {
+	src = filepath.Clean(src)
 	dst = filepath.Clean(dst)
 	if dst[len(dst)-1] == os.PathSeparator {
 		return fmt.Errorf("Move to root folder %s not allowed for safety", dst)
 	}
-	dst += string(os.PathSeparator)
 	dir := filepath.Dir(src)
 	if dir[len(dir)-1] == os.PathSeparator {
-		return fmt.Errorf("Moving %s from root folder not allowed for safety", dst)
+		return fmt.Errorf("Moving %s from root folder not allowed for safety", src)
 	}
-	// Many safety checks to perform here...
-	if runtime.GOOS == "windows" {
-		// hidden files will wreak havoc with move across devices
-		err := RunCommand("move", "/Y", quoteString(src), quoteString(dst))
-		if err != nil {
-			// So if we get any errors we retry via copy & delete
-			err = CommandCopy(src, dst)
-			if err == nil {
-				err = CommandDelete(src)
-			}
-		}
-		return err
+	target := filepath.Join(dst, filepath.Base(src))
+	if target == src {
+		return nil
+	}
+	if isInside(target, src) {
+		return fmt.Errorf("Can't move %s into itself", src)
 	}
-	return RunCommand("mv", "-f", src, dst)
+	m := mover{copier{ctx: ctx, cb: cb}}
+	m.moveReported(src, target)
+	return m.err()
 }
 
-// CommandDelete deletes a given file or folder
+// CommandDelete permanently deletes a given file or folder
 // Fails if the target is the root folder
-// If command fails, returns the system error and the output of the command
 func CommandDelete(dst string) error {
 	dst = filepath.Clean(dst)
 	dir := filepath.Dir(dst)
 	if dir[len(dir)-1] == os.PathSeparator {
 		return fmt.Errorf("Deleting %s from root folder not allowed for safety", dst)
 	}
-	// Many safety checks to perform here...
-	if runtime.GOOS == "windows" {
-		// Deleting files in directories and deleting directories are two
-		// separate things :(
-		err := RunCommand("del", "/Q", "/A", "/F", quoteString(dst))
-		if err == nil {
-			// Must ignore the error because dst may have been fully deleted by prev command
-			// UGH
-			/*err = */
-			RunCommand("rd", "/S", "/Q", quoteString(dst))
-		}
+	err := os.RemoveAll(dst)
+	if err != nil && runtime.GOOS == "windows" {
+		// Read only files can't be deleted on Windows, like del /F
+		// we make them writable and try again
+		filepath.Walk(dst, func(path string, info os.FileInfo, err error) error {
+			if err == nil && info.Mode()&0200 == 0 {
+				os.Chmod(path, 0600)
+			}
+			return nil
+		})
+		err = os.RemoveAll(dst)
+	}
+	return err
+}
+
+// CheckFileName returns an error if name can't be used as the name
+// of a new entry in a folder
+func CheckFileName(name string) error {
+	if name == "" || strings.TrimSpace(name) == "" {
+		return fmt.Errorf("The name can't be empty")
+	}
+	if name == "." || name == ".." {
+		return fmt.Errorf("%s is not a valid name", name)
+	}
+	if strings.ContainsRune(name, '/') || strings.ContainsRune(name, os.PathSeparator) {
+		return fmt.Errorf("The name %s can't contain path separators", name)
+	}
+	return nil
+}
+
+// CommandRename renames src to dst, which must not exist unless
+// it is the same file (eg changing case on case insensitive systems)
+func CommandRename(src string, dst string) error {
+	srcInfo, err := os.Lstat(src)
+	if err != nil {
 		return err
 	}
-	return RunCommand("rm", "-rf", dst)
+	if dstInfo, err := os.Lstat(dst); err == nil && !os.SameFile(srcInfo, dstInfo) {
+		return fmt.Errorf("%s already exists", dst)
+	}
+	return os.Rename(src, dst)
+}
+
+// CommandMkdir creates a new folder
+func CommandMkdir(dst string) error {
+	return os.Mkdir(dst, 0777)
+}
+
+// CommandTouch creates a new empty file, returning true if it did.
+// If the file exists, its modification time is updated instead
+func CommandTouch(dst string) (bool, error) {
+	f, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0666)
+	if err == nil {
+		return true, f.Close()
+	}
+	if !os.IsExist(err) {
+		return false, err
+	}
+	now := time.Now()
+	return false, os.Chtimes(dst, now, now)
 }
@@ -0,0 +1,363 @@
+// Copyright 2017 Javier Arevalo <jare@iguanademos.com>
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+// http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Filtering the entries shown in a panel by name,
+// and jumping to entries by typing their names
+
+package main
+
+import (
+	"regexp"
+	"strings"
+	"unicode"
+
+	"github.com/nsf/termbox-go"
+)
+
+type filterMode int
+
+const (
+	filterSubstring filterMode = iota
+	filterGlob
+	filterFuzzy
+)
+
+func (m filterMode) String() string {
+	switch m {
+	case filterSubstring:
+		return "substring"
+	case filterGlob:
+		return "glob"
+	case filterFuzzy:
+		return "fuzzy"
+	}
+	return "unknown"
+}
+
+// nameFilter matches entry names, ignoring case
+type nameFilter struct {
+	Mode filterMode
+	Text string
+	// Glob patterns are turned into a regexp, with the literal
+	// parts as groups so they can be highlighted
+	glob *regexp.Regexp
+}
+
+// newNameFilter creates a filter. Glob patterns that are not valid
+// match nothing
+func newNameFilter(mode filterMode, text string) *nameFilter {
+	f := &nameFilter{Mode: mode, Text: text}
+	if mode == filterGlob {
+		f.glob, _ = regexp.Compile(globToRegexp(text))
+	}
+	return f
+}
+
+// globToRegexp converts a glob pattern with *, ? and [...] into a
+// case insensitive regexp matching whole names
+func globToRegexp(glob string) string {
+	var b strings.Builder
+	b.WriteString("(?i)^")
+	literal := ""
+	flush := func() {
+		if literal != "" {
+			b.WriteString("(" + regexp.QuoteMeta(literal) + ")")
+			literal = ""
+		}
+	}
+	runes := []rune(glob)
+	for i := 0; i < len(runes); i++ {
+		switch c := runes[i]; c {
+		case '*':
+			flush()
+			b.WriteString(".*")
+		case '?':
+			flush()
+			b.WriteString(".")
+		case '[':
+			end := strings.IndexRune(string(runes[i+1:]), ']')
+			if end < 0 {
+				literal += string(c)
+				continue
+			}
+			flush()
+			class := []rune(string(runes[i+1:])[:end])
+			if len(class) > 0 && class[0] == '!' {
+				class[0] = '^'
+			}
+			b.WriteString("[" + strings.Replace(string(class), `\`, `\\`, -1) + "]")
+			i += len(class) + 1
+		default:
+			literal += string(c)
+		}
+	}
+	flush()
+	b.WriteString("$")
+	return b.String()
+}
+
+// Match returns whether name passes the filter, and the positions of
+// the runes in name that matched, to highlight them
+func (f *nameFilter) Match(name string) (bool, []int) {
+	if f.Text == "" {
+		return true, nil
+	}
+	runes := []rune(strings.ToLower(name))
+	text := []rune(strings.ToLower(f.Text))
+	switch f.Mode {
+	case filterSubstring:
+		i := strings.Index(string(runes), string(text))
+		if i < 0 {
+			return false, nil
+		}
+		start := len([]rune(string(runes)[:i]))
+		return true, runeRange(start, start+len(text))
+	case filterGlob:
+		if f.glob == nil {
+			return false, nil
+		}
+		m := f.glob.FindStringSubmatchIndex(name)
+		if m == nil {
+			return false, nil
+		}
+		var pos []int
+		for g := 2; g+1 < len(m); g += 2 {
+			start := len([]rune(name[:m[g]]))
+			pos = append(pos, runeRange(start, start+len([]rune(name[m[g]:m[g+1]])))...)
+		}
+		return true, pos
+	case filterFuzzy:
+		return fuzzyMatch(runes, text)
+	}
+	return false, nil
+}
+
+func runeRange(from, to int) []int {
+	r := make([]int, 0, to-from)
+	for i := from; i < to; i++ {
+		r = append(r, i)
+	}
+	return r
+}
+
+// fuzzyMatch checks if all the runes of text appear in name in the same
+// order, returning their positions. Spaces in text are ignored
+func fuzzyMatch(name []rune, text []rune) (bool, []int) {
+	var pos []int
+	i := 0
+	for _, c := range text {
+		if unicode.IsSpace(c) {
+			continue
+		}
+		for i < len(name) && name[i] != c {
+			i++
+		}
+		if i == len(name) {
+			return false, nil
+		}
+		pos = append(pos, i)
+		i++
+	}
+	return true, pos
+}
+
+// ------------------
+
+// filterView edits the filter of the active panel in the status line,
+// updating the panel as the text changes
+type filterView struct {
+	panel  *Panel
+	mode   filterMode
+	editor *LineEditor
+}
+
+func newFilterView(p *Panel) *filterView {
+	v := &filterView{panel: p, editor: NewLineEditor("")}
+	if p.Filter != nil {
+		v.mode = p.Filter.Mode
+		v.editor.SetText(p.Filter.Text)
+	}
+	return v
+}
+
+func (v *filterView) update() {
+	if v.editor.Text() == "" {
+		v.panel.SetFilter(nil)
+	} else {
+		v.panel.SetFilter(newNameFilter(v.mode, v.editor.Text()))
+	}
+}
+
+func (v *filterView) Render(w, h int) {
+}
+
+func (v *filterView) RenderStatus(y, w int) {
+	x := tbprint(0, y, termbox.ColorYellow|termbox.AttrBold, termbox.ColorDefault, "Filter ("+v.mode.String()+"): ")
+	hint := " [ENTER keep] [ESC clear] [TAB mode]"
+	ew := w - x - len(hint)
+	if ew < 10 {
+		ew = w - x
+	}
+	v.editor.Render(x, y, ew, termbox.ColorWhite, termbox.ColorBlue, true)
+	tbprintw(x+ew, y, w-x-ew, termbox.ColorDefault, termbox.ColorDefault, hint)
+}
+
+func (v *filterView) HandleKey(ev termbox.Event) bool {
+	switch ev.Key {
+	case termbox.KeyEnter:
+		return false
+	case termbox.KeyEsc:
+		v.panel.SetFilter(nil)
+		return false
+	case termbox.KeyTab:
+		v.mode = (v.mode + 1) % 3
+		v.update()
+		return true
+	case termbox.KeyArrowUp:
+		v.panel.Cursor--
+		return true
+	case termbox.KeyArrowDown:
+		v.panel.Cursor++
+		return true
+	case termbox.KeyPgup:
+		v.panel.Cursor -= 10
+		return true
+	case termbox.KeyPgdn:
+		v.panel.Cursor += 10
+		return true
+	}
+	if v.editor.HandleKey(ev) {
+		v.update()
+	}
+	return true
+}
+
+func (v *filterView) Help() string {
+	return ""
+}
+
+// ------------------
+
+// lastSearch is the text of the last quick search, to repeat it
+var lastSearch string
+
+// searchPanel finds the next entry in p, starting at from and going in
+// direction dir (1 or -1), whose name starts with text. If no name
+// starts with it, names that fuzzy match it are searched instead.
+// Returns -1 if nothing matches
+func searchPanel(p *Panel, text string, from int, dir int) int {
+	text = strings.ToLower(text)
+	n := len(p.Entries)
+	if text == "" || n == 0 {
+		return -1
+	}
+	prefix := func(name string) bool {
+		return strings.HasPrefix(strings.ToLower(name), text)
+	}
+	fuzzy := func(name string) bool {
+		ok, _ := fuzzyMatch([]rune(strings.ToLower(name)), []rune(text))
+		return ok
+	}
+	for _, match := range []func(string) bool{prefix, fuzzy} {
+		for i := 0; i < n; i++ {
+			k := ((from+i*dir)%n + n) % n
+			if match(p.Entries[k].Name()) {
+				return k
+			}
+		}
+	}
+	return -1
+}
+
+// searchView moves the cursor of a panel to the entries matching
+// the text typed, shown in the status line
+type searchView struct {
+	panel   *Panel
+	editor  *LineEditor
+	start   int
+	missing bool
+}
+
+func newSearchView(p *Panel) *searchView {
+	return &searchView{panel: p, editor: NewLineEditor(""), start: p.Cursor}
+}
+
+// jump moves the cursor to the next match from the given entry
+func (v *searchView) jump(from int, dir int) {
+	i := searchPanel(v.panel, v.editor.Text(), from, dir)
+	v.missing = i < 0 && v.editor.Text() != ""
+	if i >= 0 {
+		v.panel.Cursor = i
+	}
+}
+
+func (v *searchView) Render(w, h int) {
+}
+
+func (v *searchView) RenderStatus(y, w int) {
+	x := tbprint(0, y, termbox.ColorYellow|termbox.AttrBold, termbox.ColorDefault, "Search: ")
+	hint := " [DOWN,^N next] [UP,^P previous] [ENTER done] [ESC cancel]"
+	if v.missing {
+		hint = " No match" + hint
+	}
+	ew := w - x - len(hint)
+	if ew < 10 {
+		ew = w - x
+	}
+	v.editor.Render(x, y, ew, termbox.ColorWhite, termbox.ColorBlue, true)
+	fg := termbox.ColorDefault
+	if v.missing {
+		fg = termbox.ColorRed
+	}
+	tbprintw(x+ew, y, w-x-ew, fg, termbox.ColorDefault, hint)
+}
+
+func (v *searchView) HandleKey(ev termbox.Event) bool {
+	switch ev.Key {
+	case termbox.KeyEnter:
+		lastSearch = v.editor.Text()
+		return false
+	case termbox.KeyEsc:
+		v.panel.Cursor = v.start
+		return false
+	case termbox.KeyArrowDown, termbox.KeyCtrlN:
+		v.jump(v.panel.Cursor+1, 1)
+		return true
+	case termbox.KeyArrowUp, termbox.KeyCtrlP:
+		v.jump(v.panel.Cursor-1, -1)
+		return true
+	}
+	if v.editor.HandleKey(ev) {
+		// The current entry stays if it still matches
+		v.jump(v.panel.Cursor, 1)
+	}
+	return true
+}
+
+func (v *searchView) Help() string {
+	return ""
+}
+
+// searchNext moves the cursor to the next entry matching the last search
+func searchNext(p *Panel) {
+	if lastSearch == "" {
+		status = "No previous search, press / to search"
+		return
+	}
+	if i := searchPanel(p, lastSearch, p.Cursor+1, 1); i >= 0 {
+		p.Cursor = i
+	} else {
+		status = "No entry matches " + lastSearch
+	}
+}
@@ -0,0 +1,450 @@
+// Copyright 2017 Javier Arevalo <jare@iguanademos.com>
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+// http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Finding files in a folder tree, with the results shown in a panel
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"code.cloudfoundry.org/bytefmt"
+	"github.com/nsf/termbox-go"
+)
+
+// foundFile is an entry in a panel showing search results. Its name
+// is the path relative to the folder searched, so entries are unique
+// and can be selected and filtered like in a normal panel
+type foundFile struct {
+	os.FileInfo
+	rel  string
+	path string
+}
+
+func (f *foundFile) Name() string {
+	return f.rel
+}
+
+// findQuery describes the files to look for. Zero values
+// mean any file passes that test
+type findQuery struct {
+	Root    string
+	Name    *regexp.Regexp
+	MinSize int64
+	MaxSize int64
+	After   time.Time
+	Before  time.Time
+	// "file", "folder" or "link", empty for any
+	Type     string
+	Contains []byte
+	// For the panel title
+	Desc string
+}
+
+// finder walks a folder tree in the background, collecting the files
+// that match a query. The main loop takes them with Take
+type finder struct {
+	query  findQuery
+	ctx    context.Context
+	cancel context.CancelFunc
+	mu     sync.Mutex
+	found  []os.FileInfo
+	count  int
+	errs   int
+	done   bool
+}
+
+// startFind begins searching in a new goroutine
+func startFind(q findQuery) *finder {
+	f := &finder{query: q}
+	f.ctx, f.cancel = context.WithCancel(context.Background())
+	go f.run()
+	return f
+}
+
+func (f *finder) run() {
+	err := filepath.Walk(f.query.Root, func(path string, info os.FileInfo, err error) error {
+		if f.ctx.Err() != nil {
+			return ErrCancelled
+		}
+		if err != nil {
+			// Unreadable folders are skipped
+			f.mu.Lock()
+			f.errs++
+			f.mu.Unlock()
+			return nil
+		}
+		if path == f.query.Root || !f.matches(path, info) {
+			return nil
+		}
+		rel, _ := filepath.Rel(f.query.Root, path)
+		f.mu.Lock()
+		f.found = append(f.found, &foundFile{info, rel, path})
+		f.count++
+		f.mu.Unlock()
+		notifyUI()
+		return nil
+	})
+	if err != nil && err != ErrCancelled {
+		Logf("Find in %s failed: %s\n", f.query.Root, err)
+	}
+	f.mu.Lock()
+	f.done = true
+	f.mu.Unlock()
+	notifyUI()
+}
+
+func (f *finder) matches(path string, info os.FileInfo) bool {
+	q := &f.query
+	if q.Name != nil && !q.Name.MatchString(info.Name()) {
+		return false
+	}
+	switch q.Type {
+	case "file":
+		if !info.Mode().IsRegular() {
+			return false
+		}
+	case "folder":
+		if !info.IsDir() {
+			return false
+		}
+	case "link":
+		if info.Mode()&os.ModeSymlink == 0 {
+			return false
+		}
+	}
+	// Folder sizes are meaningless, so they never match a size
+	if (q.MinSize > 0 || q.MaxSize > 0) && info.IsDir() {
+		return false
+	}
+	if q.MinSize > 0 && info.Size() < q.MinSize {
+		return false
+	}
+	if q.MaxSize > 0 && info.Size() > q.MaxSize {
+		return false
+	}
+	if !q.After.IsZero() && info.ModTime().Before(q.After) {
+		return false
+	}
+	if !q.Before.IsZero() && !info.ModTime().Before(q.Before) {
+		return false
+	}
+	if len(q.Contains) > 0 {
+		return info.Mode().IsRegular() && f.fileContains(path)
+	}
+	return true
+}
+
+// fileContains reads a file looking for the query text
+func (f *finder) fileContains(path string) bool {
+	file, err := os.Open(path)
+	if err != nil {
+		return false
+	}
+	defer file.Close()
+	text := f.query.Contains
+	buf := make([]byte, 256*1024)
+	keep := 0
+	for f.ctx.Err() == nil {
+		n, err := file.Read(buf[keep:])
+		data := buf[:keep+n]
+		if bytes.Contains(data, text) {
+			return true
+		}
+		if err != nil {
+			return false
+		}
+		// Keep the end of the data, in case the text crosses blocks
+		keep = len(text) - 1
+		if keep > len(data) {
+			keep = len(data)
+		}
+		copy(buf, data[len(data)-keep:])
+	}
+	return false
+}
+
+// Take returns the files found since the last call
+func (f *finder) Take() []os.FileInfo {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	found := f.found
+	f.found = nil
+	return found
+}
+
+// Running returns whether the search is still going on
+func (f *finder) Running() bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return !f.done
+}
+
+// Cancel stops the search
+func (f *finder) Cancel() {
+	f.cancel()
+}
+
+// Title describes the search and its progress for the panel title
+func (f *finder) Title() string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	state := "done"
+	if !f.done {
+		state = "searching..."
+	} else if f.ctx.Err() != nil {
+		state = "cancelled"
+	}
+	s := fmt.Sprintf("Find in %s: %s [%d found, %s", f.query.Root, f.query.Desc, f.count, state)
+	if f.errs > 0 {
+		s += fmt.Sprintf(", %d unreadable", f.errs)
+	}
+	return s + "]"
+}
+
+// ------------------
+
+// startSearchPanel turns a panel into a view of the results of a search
+func startSearchPanel(p *Panel, q findQuery) {
+	if p.Search != nil {
+		p.Search.Cancel()
+	} else if p.Cursor < len(p.Entries) {
+		// To return to it when leaving the results
+		setCachedCursor(p.Cwd, p.Entries[p.Cursor].Name())
+	}
+	p.Cwd = q.Root
+	p.All = nil
+	p.Top = 0
+	p.Cursor = 0
+	p.Selected = make(map[string]bool)
+	p.Filter = nil
+	p.applyFilter()
+	p.Search = startFind(q)
+}
+
+// updateSearch adds to the panel the results found since the last call
+func (p *Panel) updateSearch() {
+	if p.Search == nil {
+		return
+	}
+	found := p.Search.Take()
+	if len(found) == 0 {
+		return
+	}
+	cursor := ""
+	if p.Cursor < len(p.Entries) {
+		cursor = p.Entries[p.Cursor].Name()
+	}
+	p.All = append(p.All, found...)
+	p.applyFilter()
+	p.SetCursor(cursor)
+}
+
+// refreshSearch updates the results of a search with the current
+// state of the files, removing those that don't exist anymore
+func (p *Panel) refreshSearch() {
+	p.updateSearch()
+	cursor, cursorIndex := "", p.Cursor
+	if p.Cursor < len(p.Entries) {
+		cursor = p.Entries[p.Cursor].Name()
+	}
+	var all []os.FileInfo
+	for _, e := range p.All {
+		f := e.(*foundFile)
+		info, err := os.Lstat(f.path)
+		if err != nil {
+			delete(p.Selected, f.rel)
+			continue
+		}
+		all = append(all, &foundFile{info, f.rel, f.path})
+	}
+	p.All = all
+	p.applyFilter()
+	p.Cursor = cursorIndex
+	p.SetCursor(cursor)
+	if p.Cursor >= len(p.Entries) {
+		p.Cursor = len(p.Entries) - 1
+	}
+}
+
+// processSearchResults shows the files found by the panels' searches
+func processSearchResults() {
+	lp.updateSearch()
+	rp.updateSearch()
+}
+
+// ------------------
+
+var findTypes = []string{"any", "file", "folder", "link"}
+
+// findView is the dialog to start a search under the active panel's folder
+type findView struct {
+	form     Form
+	name     *FormField
+	nameMode *FormField
+	minSize  *FormField
+	maxSize  *FormField
+	after    *FormField
+	before   *FormField
+	kind     *FormField
+	contains *FormField
+}
+
+func newFindView() *findView {
+	v := &findView{}
+	v.name = v.form.AddText("Name", "")
+	v.nameMode = v.form.AddChoice("Name is a", "glob", "regexp")
+	v.minSize = v.form.AddText("Minimum size", "")
+	v.maxSize = v.form.AddText("Maximum size", "")
+	v.after = v.form.AddText("Modified after", "")
+	v.before = v.form.AddText("Modified before", "")
+	v.kind = v.form.AddChoice("Type", findTypes...)
+	v.contains = v.form.AddText("Containing text", "")
+	return v
+}
+
+// parseSize reads sizes like 1024, 10K or 1.5M
+func parseSize(s string) (int64, error) {
+	s = strings.TrimSpace(s)
+	if s == "" {
+		return 0, nil
+	}
+	if n, err := strconv.ParseInt(s, 10, 64); err == nil {
+		return n, nil
+	}
+	n, err := bytefmt.ToBytes(s)
+	if err != nil {
+		return 0, fmt.Errorf("Bad size %s, use a number of bytes or K, M, G suffixes", s)
+	}
+	return int64(n), nil
+}
+
+// parseTime reads dates like 2017-06-30, 2017-06-30 18:00, or
+// times relative to now like 3d (days ago) or 2h (hours ago)
+func parseTime(s string) (time.Time, error) {
+	s = strings.TrimSpace(s)
+	if s == "" {
+		return time.Time{}, nil
+	}
+	if n := len(s) - 1; n > 0 {
+		units := map[byte]time.Duration{'m': time.Minute, 'h': time.Hour, 'd': 24 * time.Hour, 'w': 7 * 24 * time.Hour}
+		if unit, ok := units[s[n]]; ok {
+			if v, err := strconv.Atoi(s[:n]); err == nil {
+				return time.Now().Add(-time.Duration(v) * unit), nil
+			}
+		}
+	}
+	for _, layout := range []string{"2006-01-02", "2006-01-02 15:04", "2006-01-02 15:04:05"} {
+		if t, err := time.ParseInLocation(layout, s, time.Local); err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("Bad date %s, use YYYY-MM-DD [hh:mm] or a number of m, h, d or w ago", s)
+}
+
+// query builds the search from the fields of the dialog
+func (v *findView) query() (findQuery, error) {
+	q := findQuery{Root: ap.Cwd}
+	var desc []string
+	var err error
+	if name := v.name.Text(); name != "" {
+		expr := name
+		if v.nameMode.Text() == "glob" {
+			expr = globToRegexp(name)
+		}
+		if q.Name, err = regexp.Compile(expr); err != nil {
+			return q, fmt.Errorf("Bad name pattern: %s", err)
+		}
+		desc = append(desc, name)
+	}
+	if q.MinSize, err = parseSize(v.minSize.Text()); err != nil {
+		return q, err
+	}
+	if q.MaxSize, err = parseSize(v.maxSize.Text()); err != nil {
+		return q, err
+	}
+	if q.MinSize > 0 {
+		desc = append(desc, ">= "+v.minSize.Text())
+	}
+	if q.MaxSize > 0 {
+		desc = append(desc, "<= "+v.maxSize.Text())
+	}
+	if q.After, err = parseTime(v.after.Text()); err != nil {
+		return q, err
+	}
+	if q.Before, err = parseTime(v.before.Text()); err != nil {
+		return q, err
+	}
+	if !q.After.IsZero() {
+		desc = append(desc, "after "+v.after.Text())
+	}
+	if !q.Before.IsZero() {
+		desc = append(desc, "before "+v.before.Text())
+	}
+	if kind := v.kind.Text(); kind != "any" {
+		q.Type = kind
+		desc = append(desc, kind+"s")
+	}
+	if text := v.contains.Text(); text != "" {
+		q.Contains = []byte(text)
+		desc = append(desc, fmt.Sprintf("containing %q", text))
+	}
+	if len(desc) == 0 {
+		desc = append(desc, "everything")
+	}
+	q.Desc = strings.Join(desc, ", ")
+	return q, nil
+}
+
+func (v *findView) Render(w, h int) {
+	bw := w - 4
+	if bw > 80 {
+		bw = 80
+	}
+	bh := len(v.form.Fields) + 4
+	x, y := (w-bw)/2, (h-bh)/2
+	drawBox(x, y, bw, bh, "Find in "+ap.Cwd)
+	v.form.Render(x+2, y+1, bw-4)
+	tbprintw(x+2, y+bh-2, bw-4, termbox.ColorCyan, termbox.ColorDefault, "Sizes like 10K or 2M, dates like 2017-06-30 or 3d ago")
+}
+
+func (v *findView) HandleKey(ev termbox.Event) bool {
+	switch ev.Key {
+	case termbox.KeyEsc:
+		return false
+	case termbox.KeyEnter:
+		q, err := v.query()
+		if err != nil {
+			status = err.Error()
+			return true
+		}
+		startSearchPanel(ap, q)
+		return false
+	}
+	v.form.HandleKey(ev)
+	return true
+}
+
+func (v *findView) Help() string {
+	return "[ENTER find] [ESC cancel] [TAB,UP/DOWN fields] [LEFT/RIGHT options]"
+}
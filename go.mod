@@ -7,4 +7,5 @@ require (
 	github.com/nsf/termbox-go v0.0.0-20180819125858-b66b20ab708e
 	github.com/spf13/cobra v0.0.3
 	github.com/spf13/viper v1.2.1
+	golang.org/x/text v0.3.0
 )
@@ -0,0 +1,414 @@
+// Copyright 2017 Javier Arevalo <jare@iguanademos.com>
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+// http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Searching the contents of files
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+
+	"github.com/mattn/go-runewidth"
+	"github.com/nsf/termbox-go"
+)
+
+// grepMatch is a line of a file that matched
+type grepMatch struct {
+	Path string
+	Line int
+	Text string
+}
+
+// The search stops after this many matches
+const maxGrepMatches = 10000
+
+// Longer lines are cut when shown in the results
+const maxGrepLine = 1024
+
+// Only the start of longer lines is searched, the rest is skipped
+const maxGrepScan = 64 * 1024
+
+// grepper searches files in the background for lines matching a regexp
+type grepper struct {
+	re     *regexp.Regexp
+	ctx    context.Context
+	cancel context.CancelFunc
+	mu     sync.Mutex
+	found  []grepMatch
+	files  int
+	binary int
+	errs   int
+	done   bool
+}
+
+func startGrep(paths []string, re *regexp.Regexp) *grepper {
+	g := &grepper{re: re}
+	g.ctx, g.cancel = context.WithCancel(context.Background())
+	go g.run(paths)
+	return g
+}
+
+func (g *grepper) run(paths []string) {
+	for _, root := range paths {
+		filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+			if g.ctx.Err() != nil {
+				return ErrCancelled
+			}
+			if err != nil {
+				g.count(&g.errs)
+				return nil
+			}
+			if info.Mode().IsRegular() {
+				g.grepFile(path)
+			}
+			return nil
+		})
+	}
+	g.mu.Lock()
+	g.done = true
+	g.mu.Unlock()
+	notifyUI()
+}
+
+func (g *grepper) count(n *int) {
+	g.mu.Lock()
+	*n++
+	g.mu.Unlock()
+}
+
+// isBinary checks for NUL bytes at the start of the data, like git
+func isBinary(data []byte) bool {
+	if len(data) > 8000 {
+		data = data[:8000]
+	}
+	return bytes.IndexByte(data, 0) >= 0
+}
+
+func (g *grepper) grepFile(path string) {
+	f, err := os.Open(path)
+	if err != nil {
+		g.count(&g.errs)
+		return
+	}
+	defer f.Close()
+	r := bufio.NewReaderSize(f, maxGrepScan)
+	if head, _ := r.Peek(8000); isBinary(head) {
+		g.count(&g.binary)
+		return
+	}
+	g.count(&g.files)
+	for n := 1; g.ctx.Err() == nil; n++ {
+		line, err := readGrepLine(r)
+		line = bytes.TrimRight(line, "\r\n")
+		if g.re.Match(line) {
+			if len(line) > maxGrepLine {
+				line = line[:maxGrepLine]
+			}
+			g.mu.Lock()
+			g.found = append(g.found, grepMatch{path, n, string(line)})
+			full := len(g.found) >= maxGrepMatches
+			g.mu.Unlock()
+			notifyUI()
+			if full {
+				g.cancel()
+			}
+		}
+		if err != nil {
+			if err != io.EOF {
+				g.count(&g.errs)
+			}
+			return
+		}
+	}
+}
+
+// readGrepLine reads a line, keeping at most the size of the buffer of r
+// and skipping the rest, so huge lines don't fill the memory
+func readGrepLine(r *bufio.Reader) ([]byte, error) {
+	line, err := r.ReadSlice('\n')
+	if err != bufio.ErrBufferFull {
+		return line, err
+	}
+	line = append([]byte(nil), line...)
+	for err == bufio.ErrBufferFull {
+		_, err = r.ReadSlice('\n')
+	}
+	return line, err
+}
+
+// Running returns whether the search is still going on
+func (g *grepper) Running() bool {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return !g.done
+}
+
+// Matches returns the matches found so far
+func (g *grepper) Matches() []grepMatch {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return g.found
+}
+
+// Summary describes the progress of the search
+func (g *grepper) Summary() string {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	s := fmt.Sprintf("%d matches in %d files", len(g.found), g.files)
+	if g.binary > 0 {
+		s += fmt.Sprintf(", %d binary files skipped", g.binary)
+	}
+	if g.errs > 0 {
+		s += fmt.Sprintf(", %d unreadable", g.errs)
+	}
+	if !g.done {
+		s += ", searching..."
+	} else if len(g.found) >= maxGrepMatches {
+		s += ", stopped at the maximum"
+	} else if g.ctx.Err() != nil {
+		s += ", cancelled"
+	}
+	return s
+}
+
+// ------------------
+
+// lastGrep keeps the results of the last search, to go back to them
+var lastGrep *grepResultsView
+
+// grepView is the dialog to start searching the contents of the
+// selected files and folders, or the current folder
+type grepView struct {
+	form    Form
+	pattern *FormField
+	mode    *FormField
+	cased   *FormField
+	paths   []string
+}
+
+func newGrepView() *grepView {
+	v := &grepView{}
+	if ap.SelectedCount() > 0 {
+		v.paths, _ = getCommandArguments()
+	} else {
+		v.paths = []string{ap.Cwd}
+	}
+	v.pattern = v.form.AddText("Search for", "")
+	v.mode = v.form.AddChoice("Match as", "literal text", "regexp")
+	v.cased = v.form.AddChoice("Case", "insensitive", "sensitive")
+	return v
+}
+
+func (v *grepView) where() string {
+	if len(v.paths) == 1 {
+		return v.paths[0]
+	}
+	return fmt.Sprintf("%d selected entries", len(v.paths))
+}
+
+func (v *grepView) Render(w, h int) {
+	bw := w - 4
+	if bw > 80 {
+		bw = 80
+	}
+	bh := len(v.form.Fields) + 2
+	x, y := (w-bw)/2, (h-bh)/2
+	drawBox(x, y, bw, bh, "Search contents of "+v.where())
+	v.form.Render(x+2, y+1, bw-4)
+}
+
+func (v *grepView) HandleKey(ev termbox.Event) bool {
+	switch ev.Key {
+	case termbox.KeyEsc:
+		return false
+	case termbox.KeyEnter:
+		text := v.pattern.Text()
+		if text == "" {
+			return true
+		}
+		expr := text
+		if v.mode.Choice == 0 {
+			expr = regexp.QuoteMeta(text)
+		}
+		if v.cased.Choice == 0 {
+			expr = "(?i)" + expr
+		}
+		re, err := regexp.Compile(expr)
+		if err != nil {
+			status = "Bad pattern: " + err.Error()
+			return true
+		}
+		if lastGrep != nil {
+			lastGrep.grep.cancel()
+		}
+		lastGrep = &grepResultsView{
+			grep:  startGrep(v.paths, re),
+			title: fmt.Sprintf("Search for %q in %s", text, v.where()),
+			root:  ap.Cwd,
+		}
+		pushView(lastGrep)
+		return false
+	}
+	v.form.HandleKey(ev)
+	return true
+}
+
+func (v *grepView) Help() string {
+	return "[ENTER search] [ESC cancel] [TAB,UP/DOWN fields] [LEFT/RIGHT options]"
+}
+
+// ------------------
+
+// showLastGrep opens again the results of the last search
+func showLastGrep() {
+	if lastGrep == nil {
+		status = "No previous search, press G to search the contents of files"
+		return
+	}
+	pushView(lastGrep)
+}
+
+// grepResultsView lists the lines found by a search as they are found
+type grepResultsView struct {
+	grep  *grepper
+	title string
+	// Paths are shown relative to this folder
+	root   string
+	top    int
+	cursor int
+}
+
+func (v *grepResultsView) Render(w, h int) {
+	h -= 2
+	matches := v.grep.Matches()
+	drawBox(0, 0, w, h, v.title+": "+v.grep.Summary())
+	rows := h - 1
+	if v.cursor >= len(matches) {
+		v.cursor = len(matches) - 1
+	}
+	if v.cursor < 0 {
+		v.cursor = 0
+	}
+	if v.cursor < v.top {
+		v.top = v.cursor
+	} else if v.cursor >= v.top+rows {
+		v.top = v.cursor - rows + 1
+	}
+	for i := 0; i < rows && v.top+i < len(matches); i++ {
+		m := &matches[v.top+i]
+		fg, bg := termbox.ColorDefault, termbox.ColorDefault
+		if v.top+i == v.cursor {
+			fg, bg = termbox.ColorBlack, termbox.ColorGreen
+		}
+		fill(0, 1+i, w, 1, termbox.Cell{Ch: ' ', Bg: bg})
+		path := m.Path
+		if rel, err := filepath.Rel(v.root, m.Path); err == nil && !strings.HasPrefix(rel, "..") {
+			path = rel
+		}
+		x := tbprintw(0, 1+i, w, termbox.ColorMagenta, bg, path)
+		x = tbprintw(x, 1+i, w-x, fg, bg, fmt.Sprintf(":%d: ", m.Line))
+		v.renderLine(x, 1+i, w-x, fg, bg, m.Text)
+	}
+}
+
+// renderLine draws a matched line without its indentation,
+// with the matches highlighted
+func (v *grepResultsView) renderLine(x, y, w int, fg, bg termbox.Attribute, text string) {
+	highlight := make([]bool, len(text))
+	for _, m := range v.grep.re.FindAllStringIndex(text, -1) {
+		for i := m[0]; i < m[1]; i++ {
+			highlight[i] = true
+		}
+	}
+	start := len(text) - len(strings.TrimLeft(text, " \t"))
+	end := x + w
+	for i, c := range text[start:] {
+		attr := fg
+		if highlight[start+i] {
+			attr = termbox.ColorRed | termbox.AttrBold
+			if bg != termbox.ColorDefault {
+				attr = termbox.ColorBlack | termbox.AttrBold | termbox.AttrUnderline
+			}
+		}
+		if c == '\t' {
+			c = ' '
+		}
+		cw := runewidth.RuneWidth(c)
+		if x+cw > end {
+			break
+		}
+		termbox.SetCell(x, y, c, attr, bg)
+		x += cw
+	}
+}
+
+func (v *grepResultsView) HandleKey(ev termbox.Event) bool {
+	if ev.Key == termbox.KeyEsc && v.grep.Running() {
+		v.grep.cancel()
+		return true
+	} else if ev.Key == termbox.KeyEsc || ev.Ch == 'q' {
+		return false
+	} else if ev.Key == termbox.KeyArrowUp || ev.Ch == 'k' {
+		v.cursor--
+	} else if ev.Key == termbox.KeyArrowDown || ev.Ch == 'j' {
+		v.cursor++
+	} else if ev.Key == termbox.KeyPgup || ev.Ch == 'u' {
+		v.cursor -= 20
+	} else if ev.Key == termbox.KeyPgdn || ev.Ch == 'i' {
+		v.cursor += 20
+	} else if ev.Key == termbox.KeyHome || ev.Ch == 'U' {
+		v.cursor = 0
+	} else if ev.Key == termbox.KeyEnd || ev.Ch == 'I' {
+		v.cursor = len(v.grep.Matches()) - 1
+	} else if ev.Key == termbox.KeyEnter {
+		matches := v.grep.Matches()
+		if v.cursor < len(matches) {
+			goToFile(ap, matches[v.cursor].Path)
+			return false
+		}
+	} else if ev.Ch == 'v' {
+		matches := v.grep.Matches()
+		if v.cursor < len(matches) {
+			v.view(matches[v.cursor])
+		}
+	}
+	return true
+}
+
+// view opens the file of a match in the viewer, at the line matched
+func (v *grepResultsView) view(m grepMatch) {
+	fv, err := newViewer(m.Path)
+	if err != nil {
+		status = err.Error()
+		return
+	}
+	fv.goToLine(int64(m.Line))
+	pushView(fv)
+}
+
+func (v *grepResultsView) Help() string {
+	if v.grep.Running() {
+		return "[ESC stop] [q close] [ARROWS nav] [ENTER go to file] [v view]"
+	}
+	return "[ESC,q close, g to reopen] [ARROWS nav] [ENTER go to file] [v view]"
+}
@@ -0,0 +1,235 @@
+// Copyright 2017 Javier Arevalo <jare@iguanademos.com>
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+// http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Hex dump mode of the viewer, for binary files
+
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/nsf/termbox-go"
+)
+
+// Bytes in each group of the hex dump that 'w' cycles through
+var hexGroupWidths = []int{1, 2, 4, 8}
+
+// detectBinary checks the start of a file for binary content
+func detectBinary(f *pagedFile) bool {
+	head := make([]byte, 8000)
+	n, _ := f.ReadAt(head, 0)
+	return isBinary(head[:n])
+}
+
+// hexOffsetWidth returns the hex digits needed for the offsets of the file
+func (v *viewer) hexOffsetWidth() int {
+	n := len(strconv.FormatInt(v.file.Size(), 16))
+	if n < 8 {
+		n = 8
+	}
+	return n
+}
+
+// hexRowWidth returns the columns taken by a row of n bytes
+func (v *viewer) hexRowWidth(n int) int {
+	return v.hexOffsetWidth() + 2 + n*2 + n/v.hexGroup - 1 + 2 + n
+}
+
+// hexRowBytes returns how many bytes fit in a row of the dump
+func (v *viewer) hexRowBytes() int {
+	for _, n := range []int{16, 8} {
+		if n >= v.hexGroup && v.hexRowWidth(n) <= v.w {
+			return n
+		}
+	}
+	if v.hexGroup > 4 {
+		return v.hexGroup
+	}
+	return 4
+}
+
+// hexAlign moves the view to the start of the row holding top
+func (v *viewer) hexAlign() {
+	n := int64(v.hexRowBytes())
+	v.top -= v.top % n
+	v.topRow = 0
+}
+
+// hexEnd returns the top offset that shows the end of the file
+func (v *viewer) hexEnd() int64 {
+	n := int64(v.hexRowBytes())
+	rows := (v.file.Size() + n - 1) / n
+	end := (rows - int64(v.h)) * n
+	if end < 0 {
+		end = 0
+	}
+	return end
+}
+
+// hexScroll moves the view the given number of rows, up if negative
+func (v *viewer) hexScroll(rows int) {
+	v.top += int64(rows * v.hexRowBytes())
+	if end := v.hexEnd(); v.top > end {
+		v.top = end
+	}
+	if v.top < 0 {
+		v.top = 0
+	}
+}
+
+// hexShowOffset scrolls to show off, with some rows above it
+func (v *viewer) hexShowOffset(off int64) {
+	v.top = off
+	v.hexAlign()
+	v.hexScroll(-v.h / 3)
+}
+
+// setHex switches between the hex dump and the text view, keeping
+// about the same part of the file on screen
+func (v *viewer) setHex(hex bool) {
+	if hex == v.hex {
+		return
+	}
+	v.hex = hex
+	if hex {
+		v.hexAlign()
+	} else {
+		v.top, v.topRow = v.lineStart(v.top), 0
+	}
+}
+
+// hexMarks marks the bytes of data, read at off, that match the search
+func (v *viewer) hexMarks(data []byte) []bool {
+	if len(v.searchText) == 0 {
+		return nil
+	}
+	if v.searchFold {
+		data = lowerASCII(append([]byte(nil), data...))
+	}
+	marks := make([]bool, len(data))
+	for start := 0; ; {
+		i := bytes.Index(data[start:], v.searchText)
+		if i < 0 {
+			break
+		}
+		for k := start + i; k < start+i+len(v.searchText); k++ {
+			marks[k] = true
+		}
+		start += i + 1
+	}
+	return marks
+}
+
+func (v *viewer) renderHex(w, h int) {
+	n := v.hexRowBytes()
+	v.hexAlign()
+	offWidth := v.hexOffsetWidth()
+	// Read past the screen so matches that continue below are marked
+	data := make([]byte, n*v.h+len(v.searchText))
+	got, _ := v.file.ReadAt(data, v.top)
+	data = data[:got]
+	marks := v.hexMarks(data)
+	for y := 0; y < v.h && y*n < len(data); y++ {
+		row := data[y*n:]
+		if len(row) > n {
+			row = row[:n]
+		}
+		off := v.top + int64(y*n)
+		x := tbprint(0, 1+y, termbox.ColorCyan, termbox.ColorDefault, fmt.Sprintf("%0*x", offWidth, off))
+		x += 2
+		ascii := x + n*2 + n/v.hexGroup - 1 + 2
+		for i, b := range row {
+			if i > 0 && i%v.hexGroup == 0 {
+				x++
+			}
+			fg, bg := termbox.ColorDefault, termbox.ColorDefault
+			if b == 0 {
+				fg = termbox.ColorBlue | termbox.AttrBold
+			}
+			if marks != nil && marks[y*n+i] {
+				fg, bg = termbox.ColorBlack, termbox.ColorYellow
+				if v.match >= 0 && off+int64(i) >= v.match && off+int64(i) < v.match+int64(len(v.searchText)) {
+					bg = termbox.ColorGreen
+				}
+			}
+			tbprint(x, 1+y, fg, bg, fmt.Sprintf("%02x", b))
+			x += 2
+			ch := rune(b)
+			if b < 0x20 || b > 0x7e {
+				ch = '.'
+				if bg == termbox.ColorDefault {
+					fg = termbox.ColorCyan
+				}
+			}
+			termbox.SetCell(ascii+i, 1+y, ch, fg, bg)
+		}
+	}
+	v.bottom = v.top + int64(got)
+	if v.bottom > v.top+int64(n*v.h) {
+		v.bottom = v.top + int64(n*v.h)
+	}
+}
+
+// hexPosition describes where the view is in the file
+func (v *viewer) hexPosition() string {
+	size := v.file.Size()
+	percent := int64(100)
+	if size > 0 {
+		percent = v.bottom * 100 / size
+	}
+	w := v.hexOffsetWidth()
+	return fmt.Sprintf("offset %0*x/%0*x %d%% [%d byte groups]", w, v.top, w, size, percent, v.hexGroup)
+}
+
+// goToOffset goes to an offset given in decimal, in hex with 0x in
+// front, or as a percentage of the file
+func (v *viewer) goToOffset(text string) {
+	text = strings.TrimSpace(text)
+	var off int64
+	if strings.HasSuffix(text, "%") {
+		p, err := strconv.ParseFloat(strings.TrimSuffix(text, "%"), 64)
+		if err != nil {
+			status = "Bad percentage " + text
+			return
+		}
+		off = int64(float64(v.file.Size()) * p / 100)
+	} else {
+		n, err := strconv.ParseInt(text, 0, 64)
+		if err != nil {
+			status = "Bad offset " + text
+			return
+		}
+		off = n
+	}
+	if off >= v.file.Size() {
+		off = v.file.Size() - 1
+	}
+	if off < 0 {
+		off = 0
+	}
+	v.top = off
+	v.hexAlign()
+}
+
+// parseHexBytes reads a sequence of bytes written in hex, with or
+// without spaces between them
+func parseHexBytes(text string) ([]byte, error) {
+	text = strings.Join(strings.Fields(text), "")
+	text = strings.TrimPrefix(strings.ToLower(text), "0x")
+	return hex.DecodeString(text)
+}
@@ -20,6 +20,7 @@ import (
 	"io"
 	"io/ioutil"
 	"os"
+	"os/signal"
 	"path/filepath"
 	"runtime"
 	"sort"
@@ -86,11 +87,22 @@ func (a ByFolderThenName) Less(i, j int) bool {
 
 // Panel contains the state of one panel
 type Panel struct {
-	Cwd      string
-	Entries  []os.FileInfo
-	Top      int
-	Cursor   int
-	Selected map[int]bool
+	Cwd string
+	// All the entries in the folder
+	All []os.FileInfo
+	// The entries shown, which pass the filter
+	Entries []os.FileInfo
+	Top     int
+	Cursor  int
+	// Selected entries by name
+	Selected map[string]bool
+	// Filter is nil when all entries are shown
+	Filter *nameFilter
+	// Positions of the matched runes in the names of Entries
+	matches [][]int
+	// Search is set when the panel shows the results of a search
+	// under Cwd instead of its contents
+	Search *finder
 }
 
 // NewPanel creates and initializes a new panel given a directory
@@ -102,45 +114,47 @@ func NewPanel(cwd string, cursor string) (*Panel, error) {
 }
 
 // Reset reinitializes a panel to given a directory
-// and an entry to set the cursor at
+// and an entry to set the cursor at. The filter is
+// cleared if the directory changes
 func (p *Panel) Reset(cwd string, cursor string) error {
 	entries, err := ioutil.ReadDir(cwd)
 	sort.Sort(ByFolderThenName(entries))
+	if cwd != p.Cwd || p.Search != nil {
+		p.Filter = nil
+	}
+	if p.Search != nil {
+		p.Search.Cancel()
+		p.Search = nil
+	}
 	p.Cwd = cwd
-	p.Entries = entries
+	p.All = entries
 	p.Top = 0
 	p.Cursor = 0
-	p.Selected = make(map[int]bool)
-	for i, v := range p.Entries {
-		if v.Name() == cursor {
-			p.Cursor = i
-			break
-		}
-	}
+	p.Selected = make(map[string]bool)
+	p.applyFilter()
+	p.SetCursor(cursor)
 	return err
 }
 
 // Refresh reinitializes a panel with its directory's contents,
 // keeping the current cursor and selection if possible
 func (p *Panel) Refresh() error {
-	if len(p.Entries) == 0 {
-		return p.Reset(p.Cwd, "")
+	if p.Search != nil {
+		p.refreshSearch()
+		return nil
 	}
-	var selection = make(map[string]bool)
+	selection := p.Selected
 	top := p.Top
-	cursor := p.Entries[p.Cursor].Name()
+	cursor := ""
 	cursorIndex := p.Cursor
-	for k := range p.Selected {
-		selection[p.Entries[k].Name()] = true
+	if p.Cursor < len(p.Entries) {
+		cursor = p.Entries[p.Cursor].Name()
 	}
 	err := p.Reset(p.Cwd, cursor)
 	if len(p.Entries) == 0 {
 		return err
 	}
 	p.Top = top
-	if err != nil {
-		return err
-	}
 	if p.Entries[p.Cursor].Name() != cursor {
 		if cursorIndex < len(p.Entries) {
 			p.Cursor = cursorIndex
@@ -148,12 +162,84 @@ func (p *Panel) Refresh() error {
 			p.Cursor = len(p.Entries) - 1
 		}
 	}
-	for k, v := range p.Entries {
+	for _, v := range p.All {
 		if selection[v.Name()] {
-			p.Selected[k] = true
+			p.Selected[v.Name()] = true
+		}
+	}
+	return err
+}
+
+// applyFilter fills Entries with the entries that pass the filter
+func (p *Panel) applyFilter() {
+	p.Entries = p.All
+	p.matches = nil
+	if p.Filter == nil {
+		return
+	}
+	p.Entries = nil
+	for _, e := range p.All {
+		if ok, m := p.Filter.Match(e.Name()); ok {
+			p.Entries = append(p.Entries, e)
+			p.matches = append(p.matches, m)
+		}
+	}
+}
+
+// SetFilter changes the filter, or removes it if f is nil,
+// keeping the cursor on the same entry if it's still shown
+func (p *Panel) SetFilter(f *nameFilter) {
+	cursor := ""
+	if p.Cursor >= 0 && p.Cursor < len(p.Entries) {
+		cursor = p.Entries[p.Cursor].Name()
+	}
+	p.Filter = f
+	p.applyFilter()
+	p.Cursor = 0
+	p.SetCursor(cursor)
+}
+
+// Path returns the full path of an entry in the panel
+func (p *Panel) Path(e os.FileInfo) string {
+	if f, ok := e.(*foundFile); ok {
+		return f.path
+	}
+	return filepath.Join(p.Cwd, e.Name())
+}
+
+// IsVirtual returns whether the panel shows search results instead
+// of the contents of a folder. Commands that create files in the
+// panel's folder don't work on virtual panels
+func (p *Panel) IsVirtual() bool {
+	return p.Search != nil
+}
+
+// IsSelected returns whether the entry at index i is selected
+func (p *Panel) IsSelected(i int) bool {
+	return p.Selected[p.Entries[i].Name()]
+}
+
+// SelectedCount returns how many of the entries shown are selected.
+// Selected entries hidden by the filter are not counted, since
+// commands don't act on them
+func (p *Panel) SelectedCount() int {
+	n := 0
+	for _, e := range p.Entries {
+		if p.Selected[e.Name()] {
+			n++
+		}
+	}
+	return n
+}
+
+// SetCursor moves the cursor to the entry with the given name, if any
+func (p *Panel) SetCursor(name string) {
+	for i, v := range p.Entries {
+		if v.Name() == name {
+			p.Cursor = i
+			return
 		}
 	}
-	return nil
 }
 
 func permc(c string, mode os.FileMode) string {
@@ -190,8 +276,9 @@ func (p *Panel) Render(x, w, h int, active bool) {
 		var fg, bg termbox.Attribute = termbox.ColorDefault, termbox.ColorDefault
 		n := i + p.Top
 		e := p.Entries[n]
+		selected := p.IsSelected(n)
 		if active {
-			if p.Selected[n] {
+			if selected {
 				if n == p.Cursor {
 					bg = termbox.ColorCyan
 					fg = termbox.ColorBlack
@@ -203,7 +290,7 @@ func (p *Panel) Render(x, w, h int, active bool) {
 				fg = termbox.ColorBlack
 			}
 		} else {
-			if p.Selected[n] {
+			if selected {
 				bg = termbox.ColorBlue
 			}
 		}
@@ -218,18 +305,33 @@ func (p *Panel) Render(x, w, h int, active bool) {
 		if e.IsDir() {
 			fn = fn + string(os.PathSeparator)
 		}
-		if p.Selected[n] {
+		prefix := 0
+		if selected {
 			fn = "*" + fn
+			prefix = 1
 		}
+		namew := w
 		if w > 50 {
+			namew = w - 32
 			fn = fmt.Sprintf("%-*.*s %-*.*s %*.*s", w-32, w-32, fn, 20, 20, e.ModTime().Format("02 Jan 2006 15:04:05"), 10, 10, bytefmt.ByteSize(uint64(e.Size())))
 		} else if w > 30 {
+			namew = w - 11
 			fn = fmt.Sprintf("%-*.*s %*.*s", w-11, w-11, fn, 10, 10, bytefmt.ByteSize(uint64(e.Size())))
 		}
 
 		tbprintw(x, i, w, fg, bg, fn)
+		if n < len(p.matches) {
+			p.renderMatches(x+prefix, i, namew-prefix, fg, bg, e.Name(), p.matches[n])
+		}
+	}
+	title := p.Cwd
+	if p.Search != nil {
+		title = p.Search.Title()
+	}
+	if p.Filter != nil {
+		title = fmt.Sprintf("%s [%s filter: %s]", title, p.Filter.Mode, p.Filter.Text)
 	}
-	nx := tbprintw(x, h, w, termbox.ColorWhite, termbox.ColorRed, p.Cwd)
+	nx := tbprintw(x, h, w, termbox.ColorWhite, termbox.ColorRed, title)
 	if p.Cursor < len(p.Entries) {
 		e := p.Entries[p.Cursor]
 		fn := fmt.Sprintf("%s %s %d %s", permissions(e.Mode()), e.ModTime().Format("Mon, 02 Jan 2006 15:04:05"), e.Size(), e.Name())
@@ -237,6 +339,25 @@ func (p *Panel) Render(x, w, h int, active bool) {
 	}
 }
 
+// renderMatches draws again the runes of name that matched the filter,
+// highlighted. The name is drawn at x, limited to w runes
+func (p *Panel) renderMatches(x, y, w int, fg, bg termbox.Attribute, name string, matches []int) {
+	if len(matches) == 0 {
+		return
+	}
+	m := 0
+	for i, c := range []rune(name) {
+		if i >= w {
+			break
+		}
+		if m < len(matches) && matches[m] == i {
+			termbox.SetCell(x, y, c, fg|termbox.AttrBold|termbox.AttrUnderline, bg)
+			m++
+		}
+		x += runewidth.RuneWidth(c)
+	}
+}
+
 // ClampPos limits the state of the panel to valid values
 func (p *Panel) ClampPos(h int) {
 	if p.Cursor >= len(p.Entries) {
@@ -337,6 +458,8 @@ var clipboard = Clipboard{}
 func redrawAll() int {
 	const coldef = termbox.ColorDefault
 	termbox.Clear(coldef, coldef)
+	// Views that edit text will show it again
+	termbox.HideCursor()
 	w, h := termbox.Size()
 
 	midx := w / 2
@@ -346,8 +469,22 @@ func redrawAll() int {
 
 	fill(midx, 0, 1, h-2, termbox.Cell{Ch: ' ', Bg: termbox.ColorRed})
 	fill(0, h-2, w, 1, termbox.Cell{Ch: ' ', Bg: termbox.ColorRed})
-	lp.Render(0, midx, h-2, lp == ap)
-	rp.Render(midx+1, w-midx-1, h-2, rp == ap)
+	// The quick view takes the place of the inactive panel
+	if quickView != nil && op == lp {
+		renderQuickView(0, midx, h-2)
+	} else {
+		lp.Render(0, midx, h-2, lp == ap)
+	}
+	if quickView != nil && op == rp {
+		renderQuickView(midx+1, w-midx-1, h-2)
+	} else {
+		rp.Render(midx+1, w-midx-1, h-2, rp == ap)
+	}
+
+	view := topView()
+	if view != nil {
+		view.Render(w, h)
+	}
 
 	// HACK:
 	// Some terminals can't hide the cursor, which may mean that writing to the bottom rightmost
@@ -355,8 +492,14 @@ func redrawAll() int {
 	// one line. This ruins the display! So use w-1 to prevent writing to that last char.
 	if status != "" {
 		tbprintw(0, h-1, w-1, termbox.ColorMagenta, coldef, status)
+	} else if sv, ok := view.(StatusLineView); ok {
+		sv.RenderStatus(h-1, w-1)
+	} else if view != nil {
+		tbprintw(0, h-1, w-1, coldef, coldef, view.Help())
+	} else if summary := jobs.Summary(); summary != "" {
+		tbprintw(0, h-1, w-1, termbox.ColorCyan, coldef, summary)
 	} else {
-		var s = "[ESC,q quit] [TAB switch] [SPC select] [ARROWS nav] [r refresh] [c Copy] [m Move] [DD Delete] [: Shell] [b/B Bookmarks] [y/Y Yank] [x/X Cut]"
+		var s = "[ESC,q quit] [TAB switch] [SPC select] [ARROWS nav] [ENTER Open] [v View] [e Edit] [V Pager] [f Filter] [/ Search] [F Find] [G Grep] [P Quick view] [r refresh] [c Copy] [m Move] [DD Trash] [t Trash] [R Rename] [E Rename in editor] [^R Pattern rename] [N Mkdir] [T Touch] [: Shell] [! Command] [O Messages] [F2 User menu] [b/B Bookmarks] [y/Y Yank] [x/X Cut] [z/Z Undo/Redo] [J Jobs]"
 		if !clipboard.IsEmpty() {
 			if clipboard.Mode == clipboardModeCopy {
 				s = s + fmt.Sprintf(" [p Copy %d files]", len(clipboard.Files))
@@ -366,24 +509,33 @@ func redrawAll() int {
 		}
 		tbprintw(0, h-1, w-1, coldef, coldef, s)
 	}
-	status = ""
 	termbox.Flush()
 
 	return h - 2
 }
 
-func redrawStatus(status string) {
-	const coldef = termbox.ColorDefault
-	w, h := termbox.Size()
-	fill(0, h-1, w, 1, termbox.Cell{Ch: ' '})
-	tbprint(0, h-1, coldef, coldef, status)
-	termbox.Flush()
+// runSuspended gives the terminal to an external program run by f,
+// and takes it back when it finishes
+func runSuspended(f func() error) error {
+	// Closing termbox stops its reader of the terminal and gives the
+	// terminal back in the state it was when jm started
+	termbox.Close()
+	restore := SaveTerminal()
+	// Ctrl-C goes to the programs run as well as to jm. Catching it keeps
+	// the Go runtime from killing jm; ignoring it with signal.Ignore
+	// instead would make the programs run ignore it too
+	interrupts := make(chan os.Signal, 1)
+	signal.Notify(interrupts, ChildSignals...)
+	err := f()
+	signal.Stop(interrupts)
+	// Undo whatever state the programs left the terminal in
+	restore()
+	termbox.Init()
+	return err
 }
 
 func runShell() string {
-	termbox.Close()
-	err := RunShell(ap.Cwd)
-	termbox.Init()
+	err := runSuspended(func() error { return RunShell(ap.Cwd) })
 	if err == nil {
 		return ""
 	}
@@ -399,6 +551,15 @@ type config struct {
 	RightPath   string
 	CursorCache map[string]string
 	Bookmarks   map[string]string
+	JobWorkers  int
+	// Lines removed in the bulk rename editor move those files to the trash
+	BulkRenameDeletes bool
+	// Colors of the syntax highlighting in the viewer
+	SyntaxColors map[string]string
+	// Programs to open files with, the first that matches is used
+	Associations []association
+	// Commands of the user menu
+	UserMenu []menuEntry
 }
 
 func writeConfig() error {
@@ -407,6 +568,11 @@ func writeConfig() error {
 	c.RightPath = rp.Cwd
 	c.CursorCache = cursorCache
 	c.Bookmarks = bookmarks
+	c.JobWorkers = jobWorkers
+	c.BulkRenameDeletes = bulkRenameDeletes
+	c.SyntaxColors = syntaxColorConfig
+	c.Associations = associations
+	c.UserMenu = userMenu
 
 	b, err := json.MarshalIndent(c, "", "  ")
 	if err != nil {
@@ -430,18 +596,108 @@ func writeConfig() error {
 func getCommandArguments() ([]string, string) {
 	var src []string
 	dst := op.Cwd
-	if len(ap.Selected) > 0 {
-		for k := range ap.Selected {
-			f := ap.Entries[k]
-			src = append(src, filepath.Join(ap.Cwd, f.Name()))
+	if ap.SelectedCount() > 0 {
+		for _, f := range ap.Entries {
+			if ap.Selected[f.Name()] {
+				src = append(src, ap.Path(f))
+			}
 		}
 	} else if len(ap.Entries) > 0 {
 		f := ap.Entries[ap.Cursor]
-		src = append(src, filepath.Join(ap.Cwd, f.Name()))
+		src = append(src, ap.Path(f))
 	}
 	return src, dst
 }
 
+// requireFolder returns whether p shows a folder, where files can be
+// created. Otherwise it shows search results, and an error is shown
+func requireFolder(p *Panel) bool {
+	if p.IsVirtual() {
+		status = "Not possible in search results, press ESC to go back to the folder"
+		return false
+	}
+	return true
+}
+
+// goToFile shows the folder holding path in a panel, with the cursor on it
+func goToFile(p *Panel, path string) {
+	dir, name := filepath.Dir(path), filepath.Base(path)
+	if err := p.Reset(dir, name); err != nil {
+		status = err.Error()
+	}
+}
+
+// selectedEntries returns the selected entries of the active panel in
+// the order they are shown, or the entry at the cursor if there is no
+// selection
+func selectedEntries() []os.FileInfo {
+	var entries []os.FileInfo
+	for _, e := range ap.Entries {
+		if ap.Selected[e.Name()] {
+			entries = append(entries, e)
+		}
+	}
+	if len(entries) == 0 && len(ap.Entries) > 0 {
+		entries = append(entries, ap.Entries[ap.Cursor])
+	}
+	return entries
+}
+
+// processJobEvents asks about conflicts found by the background jobs,
+// and updates the panels and clipboard with the results of the jobs
+// that completed since the last call
+func processJobEvents() {
+	showConflicts()
+	finished := jobs.TakeFinished()
+	for _, j := range finished {
+		if j.Err != nil {
+			// The per-file errors go to the messages, where they
+			// can all be read
+			if s := reportErrors(fmt.Sprintf("%s %s", j.Description(), j.State), j.Errs...); s != "" {
+				status = status + " " + s
+			} else {
+				status = status + " " + j.Err.Error()
+			}
+		}
+		if j.Kind == jobUndo || j.Kind == jobRedo {
+			finishUndoJob(j)
+		} else {
+			journal.Push(&undoEntry{Desc: j.Description(), Records: j.records})
+		}
+		if j.overwritten > 0 {
+			status = status + fmt.Sprintf(" %s overwrote %d files, which can't be undone.", j.Description(), j.overwritten)
+		}
+		if j.Paste && sameFiles(clipboard.Files, j.Files) {
+			// Point the clipboard to the new locations, so a wrong
+			// move can be repeated into the right place
+			clipboard.Files = nil
+			for i, s := range j.Files {
+				if j.Errs[i] != nil {
+					clipboard.Add(s)
+				} else {
+					clipboard.Add(filepath.Join(j.Dst, filepath.Base(s)))
+				}
+			}
+		}
+	}
+	if len(finished) > 0 {
+		ap.Refresh()
+		op.Refresh()
+	}
+}
+
+func sameFiles(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
 func run(ld, rd string) {
 	err := termbox.Init()
 	if err != nil {
@@ -454,6 +710,9 @@ func run(ld, rd string) {
 	rp, _ = NewPanel(rd, getCachedCursor(rd))
 	ap, op = lp, rp
 
+	go uiNotifier()
+	jobs.Start(jobWorkers)
+
 	pagesize := redrawAll()
 	// Used by commands that work with multiple keystrokes, eg DD
 	prefixCommand := ""
@@ -462,6 +721,14 @@ mainloop:
 		newCommand := ""
 		switch ev := termbox.PollEvent(); ev.Type {
 		case termbox.EventKey:
+			status = ""
+
+			if view := topView(); view != nil {
+				if !view.HandleKey(ev) {
+					closeView(view)
+				}
+				break
+			}
 
 			// Prefix commands
 			if prefixCommand == "b" {
@@ -488,28 +755,99 @@ mainloop:
 				break
 			} else if prefixCommand == "D" {
 				clipboard.Reset()
+				src, _ := getCommandArguments()
 				if ev.Ch == 'D' {
-					src, _ := getCommandArguments()
-					for i, s := range src {
-						redrawStatus(fmt.Sprintf("Deleting file %d/%d: %s", i+1, len(src), s))
-						err := CommandDelete(s)
-						if err != nil {
-							status = status + " " + err.Error()
-						}
-					}
-					ap.Refresh()
-					if ap.Cwd == op.Cwd {
-						op.Refresh()
-					}
+					jobs.Add(&Job{Kind: jobTrash, Files: src})
+				} else if ev.Ch == '!' {
+					pushView(&confirmView{
+						Prompt: fmt.Sprintf("PERMANENTLY delete %d files? This can't be undone! Press Y (uppercase) to confirm", len(src)),
+						Key:    'Y',
+						OnYes:  func() { jobs.Add(&Job{Kind: jobDelete, Files: src}) },
+					})
+				}
+				break
+			} else if prefixCommand == "q" {
+				if ev.Ch == 'q' || ev.Ch == 'Q' {
+					jobs.CancelAll()
+					termbox.Clear(termbox.ColorDefault, termbox.ColorDefault)
+					tbprint(0, 0, termbox.ColorMagenta, termbox.ColorDefault, "Cancelling jobs...")
+					termbox.Flush()
+					jobs.Wait()
+					break mainloop
 				}
 				break
 			}
 
 			// Regular commands (or detecting prefixes)
-			if ev.Key == termbox.KeyEsc || ev.Ch == 'q' || ev.Ch == 'Q' {
+			if ev.Key == termbox.KeyEsc && ap.Search != nil && ap.Search.Running() {
+				ap.Search.Cancel()
+				status = "Search cancelled"
+			} else if ev.Key == termbox.KeyEsc && ap.Filter != nil {
+				ap.SetFilter(nil)
+				status = "Filter cleared"
+			} else if ev.Key == termbox.KeyEsc && ap.IsVirtual() {
+				ap.Reset(ap.Cwd, getCachedCursor(ap.Cwd))
+			} else if ev.Key == termbox.KeyEsc && jobs.Active() > 0 {
+				n := jobs.Active()
+				pushView(&confirmView{
+					Prompt: fmt.Sprintf("Cancel %d running and pending jobs?", n),
+					OnYes:  jobs.CancelAll,
+				})
+			} else if ev.Key == termbox.KeyEsc || ev.Ch == 'q' || ev.Ch == 'Q' {
 				if prefixCommand == "" {
+					if n := jobs.Active(); n > 0 {
+						status = fmt.Sprintf("%d jobs still running. Press q again to cancel them and quit", n)
+						newCommand = "q"
+						break
+					}
 					break mainloop
 				}
+			} else if ev.Ch == 'J' {
+				pushView(&jobsView{})
+			} else if ev.Ch == 'z' {
+				startUndo()
+			} else if ev.Ch == 'Z' {
+				startRedo()
+			} else if ev.Ch == '/' {
+				pushView(newSearchView(ap))
+			} else if ev.Ch == 'n' {
+				searchNext(ap)
+			} else if ev.Ch == 'f' {
+				pushView(newFilterView(ap))
+			} else if ev.Ch == 'R' {
+				startRename()
+			} else if ev.Ch == 'E' {
+				startBulkRename()
+			} else if ev.Key == termbox.KeyCtrlR {
+				startPatternRename()
+			} else if ev.Ch == 'F' {
+				pushView(newFindView())
+			} else if ev.Ch == 'G' {
+				pushView(newGrepView())
+			} else if ev.Ch == 'g' {
+				showLastGrep()
+			} else if ev.Ch == 'P' {
+				toggleQuickView()
+			} else if ev.Key == termbox.KeyF4 || ev.Ch == 'e' {
+				editFile()
+			} else if ev.Ch == 'V' {
+				pageFile()
+			} else if ev.Ch == '!' {
+				startCommandPrompt()
+			} else if ev.Ch == 'O' {
+				showMessages()
+			} else if ev.Key == termbox.KeyF2 {
+				showUserMenu()
+			} else if ev.Key == termbox.KeyF7 || ev.Ch == 'N' {
+				startMkdir()
+			} else if ev.Ch == 'T' {
+				startTouch()
+			} else if ev.Ch == 't' {
+				if v, err := newTrashView(); err != nil {
+					status = err.Error()
+				} else {
+					pushView(v)
+				}
 			} else if ev.Key == termbox.KeyTab {
 				ap, op = op, ap
 			} else if ev.Key == termbox.KeyArrowUp || ev.Ch == 'k' {
@@ -526,6 +864,28 @@ mainloop:
 				if len(ap.Entries) > 0 {
 					ap.Cursor = len(ap.Entries) - 1
 				}
+			} else if ev.Key == termbox.KeyEnter || ev.Key == termbox.KeyF3 || ev.Ch == 'v' {
+				if ap.Cursor < len(ap.Entries) {
+					e := ap.Entries[ap.Cursor]
+					if !e.IsDir() && ev.Key == termbox.KeyEnter {
+						openFile(ap.Path(e))
+					} else if !e.IsDir() {
+						openViewer(ap.Path(e))
+					} else if ev.Key == termbox.KeyEnter {
+						if !ap.IsVirtual() {
+							setCachedCursor(ap.Cwd, e.Name())
+						}
+						n := ap.Path(e)
+						ap.Reset(n, getCachedCursor(n))
+					}
+				}
+			} else if (ev.Key == termbox.KeyArrowLeft || ev.Ch == 'h') && ap.IsVirtual() {
+				// Back to the folder that was searched
+				ap.Reset(ap.Cwd, getCachedCursor(ap.Cwd))
+			} else if (ev.Key == termbox.KeyArrowRight || ev.Ch == 'l') && ap.IsVirtual() {
+				if ap.Cursor < len(ap.Entries) {
+					goToFile(ap, ap.Path(ap.Entries[ap.Cursor]))
+				}
 			} else if ev.Key == termbox.KeyArrowLeft || ev.Ch == 'h' {
 				if ap.Cursor < len(ap.Entries) {
 					setCachedCursor(ap.Cwd, ap.Entries[ap.Cursor].Name())
@@ -540,18 +900,21 @@ mainloop:
 				}
 			} else if ev.Key == termbox.KeySpace {
 				if ap.Cursor < len(ap.Entries) {
-					if ap.Selected[ap.Cursor] {
-						delete(ap.Selected, ap.Cursor)
+					name := ap.Entries[ap.Cursor].Name()
+					if ap.Selected[name] {
+						delete(ap.Selected, name)
 					} else {
-						ap.Selected[ap.Cursor] = true
+						ap.Selected[name] = true
 					}
 				}
 			} else if ev.Ch == 'a' {
-				if len(ap.Selected) == len(ap.Entries) {
-					ap.Selected = make(map[int]bool)
-				} else {
-					for i := range ap.Entries {
-						ap.Selected[i] = true
+				// Only the entries shown by the filter
+				all := ap.SelectedCount() == len(ap.Entries)
+				for _, e := range ap.Entries {
+					if all {
+						delete(ap.Selected, e.Name())
+					} else {
+						ap.Selected[e.Name()] = true
 					}
 				}
 			} else if ev.Key == termbox.KeyF5 || ev.Ch == 'r' {
@@ -577,37 +940,19 @@ mainloop:
 				}
 			} else if ev.Ch == 'c' {
 				clipboard.Reset()
-				if ap.Cwd == op.Cwd {
+				if ap.Cwd == op.Cwd || !requireFolder(op) {
 					// Maybe add a way to duplicate files?
 					break
 				}
 				src, dst := getCommandArguments()
-				for i, s := range src {
-					redrawStatus(fmt.Sprintf("Copying file %d/%d: %s", i+1, len(src), s))
-					err := CommandCopy(s, dst)
-					if err != nil {
-						status = status + " " + err.Error()
-					}
-				}
-				op.Refresh()
-				if ap.Cwd == op.Cwd {
-					ap.Refresh()
-				}
+				jobs.Add(&Job{Kind: jobCopy, Files: src, Dst: dst})
 			} else if ev.Ch == 'm' {
 				clipboard.Reset()
-				if ap.Cwd == op.Cwd {
+				if ap.Cwd == op.Cwd || !requireFolder(op) {
 					break
 				}
 				src, dst := getCommandArguments()
-				for i, s := range src {
-					redrawStatus(fmt.Sprintf("Moving file %d/%d: %s", i+1, len(src), s))
-					err := CommandMove(s, dst)
-					if err != nil {
-						status = status + " " + err.Error()
-					}
-				}
-				ap.Refresh()
-				op.Refresh()
+				jobs.Add(&Job{Kind: jobMove, Files: src, Dst: dst})
 			} else if ev.Ch == 'x' || ev.Ch == 'X' {
 				if ev.Ch == 'x' || clipboard.Mode != clipboardModeCut {
 					clipboard.BeginCut()
@@ -625,47 +970,33 @@ mainloop:
 					clipboard.Add(s)
 				}
 			} else if ev.Ch == 'p' {
-				if clipboard.IsEmpty() {
+				if clipboard.IsEmpty() || !requireFolder(ap) {
 					break
 				}
 
-				dst := ap.Cwd
-				var newClipboard []string
-				for i, s := range clipboard.Files {
-
-					var err error
-
-					if clipboard.Mode == clipboardModeCopy {
-						redrawStatus(fmt.Sprintf("Copying file %d/%d: %s", i+1, len(clipboard.Files), s))
-						err = CommandCopy(s, dst)
-					} else {
-						redrawStatus(fmt.Sprintf("Moving file %d/%d: %s", i+1, len(clipboard.Files), s))
-						err = CommandMove(s, dst)
-					}
-					if err != nil {
-						status = status + " " + err.Error()
-						newClipboard = append(newClipboard, s)
-					} else {
-						file := filepath.Base(s)
-						newClipboard = append(newClipboard, filepath.Join(dst, file))
-					}
-				}
-				clipboard.Files = nil
-				for _, s := range newClipboard {
-					clipboard.Add(s)
+				kind := jobCopy
+				if clipboard.Mode == clipboardModeCut {
+					kind = jobMove
 				}
-				ap.Refresh()
-				op.Refresh()
+				files := append([]string(nil), clipboard.Files...)
+				jobs.Add(&Job{Kind: kind, Files: files, Dst: ap.Cwd, Paste: true})
 			} else if ev.Ch == 'D' {
 				src, _ := getCommandArguments()
 				if len(src) > 0 {
-					status = fmt.Sprintf("Press D again to confirm deleting %d files (%s)", len(src), strings.Join(src, " "))
+					status = fmt.Sprintf("Press D again to confirm moving %d files to the trash, or ! to delete them permanently (%s)", len(src), strings.Join(src, " "))
 					newCommand = "D"
 				}
 			}
 		case termbox.EventError:
 			panic(ev.Err)
+		default:
+			// Interrupts and resizes don't break multi-key commands
+			newCommand = prefixCommand
 		}
+		processJobEvents()
+		processBackgroundRuns()
+		processSearchResults()
+		updateQuickView()
 		pagesize = redrawAll()
 
 		// Keep prefix if one was stored by a command
@@ -681,6 +1012,9 @@ mainloop:
 
 // ------------------
 
+var jobWorkers = 1
+var bulkRenameDeletes = false
+
 var showVersion = false
 var logVerbose = false
 
@@ -714,6 +1048,17 @@ var rootCmd = &cobra.Command{
 
 		cursorCache = viper.GetStringMapString("CursorCache")
 		bookmarks = viper.GetStringMapString("Bookmarks")
+		jobWorkers = viper.GetInt("JobWorkers")
+		bulkRenameDeletes = viper.GetBool("BulkRenameDeletes")
+		if err := setSyntaxColors(viper.GetStringMapString("SyntaxColors")); err != nil {
+			status = err.Error()
+		}
+		if err := viper.UnmarshalKey("Associations", &associations); err != nil {
+			status = "Wrong Associations in the config file: " + err.Error()
+		}
+		if err := viper.UnmarshalKey("UserMenu", &userMenu); err != nil {
+			status = "Wrong UserMenu in the config file: " + err.Error()
+		}
 
 		// Precedence to paths from the command line
 		// Cwd and $HOME as last resort defaults
@@ -743,6 +1088,11 @@ func main() {
 	viper.SetDefault("RightPath", "")
 	viper.SetDefault("CursorCache", map[string]string{})
 	viper.SetDefault("Bookmarks", map[string]string{})
+	viper.SetDefault("JobWorkers", jobWorkers)
+	viper.SetDefault("BulkRenameDeletes", bulkRenameDeletes)
+	viper.SetDefault("SyntaxColors", defaultSyntaxColors)
+	viper.SetDefault("Associations", []association{})
+	viper.SetDefault("UserMenu", []menuEntry{})
 	home, _ := homedir.Dir()
 	configFile = filepath.Join(home, ".jm")
 	rootCmd.PersistentFlags().StringVarP(&configFile, "config", "c", configFile, "config file")
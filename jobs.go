@@ -0,0 +1,742 @@
+// Copyright 2017 Javier Arevalo <jare@iguanademos.com>
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+// http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Background queue for file operations
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"code.cloudfoundry.org/bytefmt"
+	"github.com/nsf/termbox-go"
+)
+
+type jobKind int
+
+const (
+	jobCopy jobKind = iota
+	jobMove
+	jobTrash
+	jobDelete
+	jobUndo
+	jobRedo
+)
+
+func (k jobKind) String() string {
+	switch k {
+	case jobCopy:
+		return "Copy"
+	case jobMove:
+		return "Move"
+	case jobTrash:
+		return "Trash"
+	case jobDelete:
+		return "Delete"
+	case jobUndo:
+		return "Undo"
+	case jobRedo:
+		return "Redo"
+	}
+	return "?"
+}
+
+// Verb returns the name of the operation for progress messages
+func (k jobKind) Verb() string {
+	switch k {
+	case jobCopy:
+		return "Copying"
+	case jobMove:
+		return "Moving"
+	case jobTrash:
+		return "Trashing"
+	case jobDelete:
+		return "Deleting"
+	case jobUndo:
+		return "Undoing"
+	case jobRedo:
+		return "Redoing"
+	}
+	return "?"
+}
+
+type jobState int
+
+const (
+	jobPending jobState = iota
+	jobRunning
+	jobDone
+	jobFailed
+	jobCancelled
+)
+
+func (s jobState) String() string {
+	switch s {
+	case jobPending:
+		return "pending"
+	case jobRunning:
+		return "running"
+	case jobDone:
+		return "done"
+	case jobFailed:
+		return "failed"
+	case jobCancelled:
+		return "cancelled"
+	}
+	return "?"
+}
+
+// Job is a file operation on a list of files, run by a background worker
+type Job struct {
+	ID    int
+	Kind  jobKind
+	Files []string
+	Dst   string
+	// Paste jobs update the clipboard with the new file locations
+	Paste bool
+	// Command to undo or redo in undo and redo jobs
+	Entry *undoEntry
+
+	// Progress, written by the worker while holding the queue lock
+	State   jobState
+	Current int
+	Errs    []error
+	Err     error
+	// Adding up the sizes of the files before copying them, when
+	// TotalBytes is not known yet
+	Scanning bool
+	// File inside the current entry being copied, and byte counts.
+	// Copied doesn't include moves done by renaming, so it's used
+	// to estimate the transfer rate
+	CurrentFile string
+	TotalBytes  int64
+	DoneBytes   int64
+	Copied      int64
+	Started     time.Time
+
+	// The main loop has processed the job's completion
+	handled bool
+
+	ctx    context.Context
+	cancel context.CancelFunc
+	// Answer to all conflicts, once the user chooses one. Only
+	// used by the worker
+	conflictAll *ConflictAction
+	// Completed operations, for the undo journal
+	records []undoRecord
+	// Files replaced, which can't be undone
+	overwritten int
+}
+
+// Finished returns true if the job won't do any more work
+func (j *Job) Finished() bool {
+	return j.State == jobDone || j.State == jobFailed || j.State == jobCancelled
+}
+
+// Description returns a short text describing what the job does
+func (j *Job) Description() string {
+	if j.Entry != nil {
+		return fmt.Sprintf("%s %s", j.Kind, j.Entry.Desc)
+	}
+	what := filepath.Base(j.Files[0])
+	if len(j.Files) > 1 {
+		what = fmt.Sprintf("%d files", len(j.Files))
+	}
+	if j.Kind == jobTrash || j.Kind == jobDelete {
+		return fmt.Sprintf("%s %s", j.Kind, what)
+	}
+	return fmt.Sprintf("%s %s to %s", j.Kind, what, j.Dst)
+}
+
+// Progress returns a short text describing the state of the job
+func (j *Job) Progress() string {
+	switch j.State {
+	case jobRunning:
+		if j.Scanning {
+			return fmt.Sprintf("%s scanning %d/%d: %s", j.Kind.Verb(), j.Current+1, len(j.Files), j.Files[j.Current])
+		}
+		// Moves that are just renames have no bytes to count
+		if (j.Kind != jobCopy && j.Kind != jobMove) || j.TotalBytes == 0 {
+			return fmt.Sprintf("%s file %d/%d: %s", j.Kind.Verb(), j.Current+1, len(j.Files), j.Files[j.Current])
+		}
+		file := j.CurrentFile
+		if file == "" {
+			file = j.Files[j.Current]
+		}
+		s := fmt.Sprintf("%s %s %s/%s", j.Kind.Verb(), progressBar(20, j.DoneBytes, j.TotalBytes),
+			bytefmt.ByteSize(uint64(j.DoneBytes)), bytefmt.ByteSize(uint64(j.TotalBytes)))
+		if elapsed := time.Since(j.Started); j.Copied > 0 && elapsed > time.Second {
+			rate := float64(j.Copied) / elapsed.Seconds()
+			eta := time.Duration(float64(j.TotalBytes-j.DoneBytes)/rate) * time.Second
+			s += fmt.Sprintf(" %s/s ETA %s", bytefmt.ByteSize(uint64(rate)), formatDuration(eta))
+		}
+		return s + fmt.Sprintf(" file %d/%d: %s", j.Current+1, len(j.Files), file)
+	case jobFailed, jobCancelled:
+		if j.Err != nil {
+			return j.Err.Error()
+		}
+	}
+	return j.State.String()
+}
+
+// progressBar returns a text progress bar of the given width
+// followed by the percentage done
+func progressBar(width int, done, total int64) string {
+	frac := 1.0
+	if total > 0 {
+		frac = float64(done) / float64(total)
+	}
+	if frac > 1 {
+		frac = 1
+	}
+	n := int(frac * float64(width))
+	return fmt.Sprintf("[%s%s] %3d%%", strings.Repeat("#", n), strings.Repeat(".", width-n), int(frac*100))
+}
+
+func formatDuration(d time.Duration) string {
+	d = d.Round(time.Second)
+	h, m, sec := int(d.Hours()), int(d.Minutes())%60, int(d.Seconds())%60
+	if h > 0 {
+		return fmt.Sprintf("%d:%02d:%02d", h, m, sec)
+	}
+	return fmt.Sprintf("%d:%02d", m, sec)
+}
+
+// treeSize returns the total size of the regular files under path,
+// or what it found until ctx was cancelled
+func treeSize(ctx context.Context, path string) int64 {
+	var size int64
+	filepath.Walk(path, func(_ string, info os.FileInfo, err error) error {
+		if ctx.Err() != nil {
+			return ErrCancelled
+		}
+		if err == nil && info.Mode().IsRegular() {
+			size += info.Size()
+		}
+		return nil
+	})
+	return size
+}
+
+func (j *Job) runFile(i int, cb *OpCallbacks) error {
+	file := j.Files[i]
+	switch j.Kind {
+	case jobCopy:
+		return CommandCopy(j.ctx, file, j.Dst, cb)
+	case jobMove:
+		return CommandMove(j.ctx, file, j.Dst, cb)
+	case jobTrash:
+		stamp := stampOf(file)
+		item, err := MoveToTrash(file)
+		if err == nil && TrashRestorable {
+			j.records = append(j.records, newTrashRecord(item, stamp))
+		}
+		return err
+	case jobDelete:
+		return CommandDelete(file)
+	case jobUndo:
+		return j.Entry.Records[i].undo(j.ctx)
+	case jobRedo:
+		return j.Entry.Records[i].redo(j.ctx)
+	}
+	return fmt.Errorf("Unknown job type %d", j.Kind)
+}
+
+// conflictRequest asks the user what to do about a target that
+// already exists. Workers send them to the main loop and wait for the reply
+type conflictRequest struct {
+	Job     *Job
+	Src     string
+	Dst     string
+	SrcInfo os.FileInfo
+	DstInfo os.FileInfo
+	reply   chan conflictReply
+}
+
+type conflictReply struct {
+	Action ConflictAction
+	All    bool
+	Cancel bool
+}
+
+var conflicts = make(chan *conflictRequest, 16)
+
+func (j *Job) askConflict(src string, dst string, srcInfo os.FileInfo, dstInfo os.FileInfo) ConflictAction {
+	if j.conflictAll != nil {
+		return *j.conflictAll
+	}
+	req := &conflictRequest{j, src, dst, srcInfo, dstInfo, make(chan conflictReply, 1)}
+	select {
+	case conflicts <- req:
+	case <-j.ctx.Done():
+		return ConflictSkip
+	}
+	notifyUI()
+	select {
+	case r := <-req.reply:
+		if r.Cancel {
+			j.cancel()
+			return ConflictSkip
+		}
+		if r.All {
+			j.conflictAll = &r.Action
+		}
+		return r.Action
+	case <-j.ctx.Done():
+		return ConflictSkip
+	}
+}
+
+// JobQueue holds all the jobs and the workers that run them in order
+type JobQueue struct {
+	mu   sync.Mutex
+	jobs []*Job
+	// Jobs waiting for a worker, queued is signalled when one is added
+	pending []*Job
+	queued  *sync.Cond
+	nextID  int
+	active  sync.WaitGroup
+}
+
+var jobs = newJobQueue()
+
+func newJobQueue() *JobQueue {
+	q := &JobQueue{}
+	q.queued = sync.NewCond(&q.mu)
+	return q
+}
+
+// Start launches the given number of worker goroutines
+func (q *JobQueue) Start(workers int) {
+	if workers < 1 {
+		workers = 1
+	}
+	for i := 0; i < workers; i++ {
+		go q.worker()
+	}
+}
+
+// Add queues a new job, which only needs to have the operation
+// and files filled in. Jobs without files are ignored
+func (q *JobQueue) Add(j *Job) *Job {
+	if len(j.Files) == 0 {
+		return j
+	}
+	q.mu.Lock()
+	q.nextID++
+	j.ID = q.nextID
+	j.Errs = make([]error, len(j.Files))
+	j.ctx, j.cancel = context.WithCancel(context.Background())
+	q.jobs = append(q.jobs, j)
+	q.active.Add(1)
+	// The queue has no limit, so adding never blocks the UI
+	q.pending = append(q.pending, j)
+	q.queued.Signal()
+	q.mu.Unlock()
+	return j
+}
+
+func (q *JobQueue) worker() {
+	for {
+		q.mu.Lock()
+		for len(q.pending) == 0 {
+			q.queued.Wait()
+		}
+		j := q.pending[0]
+		q.pending[0] = nil
+		q.pending = q.pending[1:]
+		q.mu.Unlock()
+		q.run(j)
+		j.cancel()
+		q.active.Done()
+		notifyUI()
+	}
+}
+
+func (q *JobQueue) run(j *Job) {
+	q.mu.Lock()
+	if j.ctx.Err() != nil {
+		j.State = jobCancelled
+		for k := range j.Errs {
+			j.Errs[k] = ErrCancelled
+		}
+		q.mu.Unlock()
+		return
+	}
+	j.State = jobRunning
+	j.Scanning = j.Kind == jobCopy || j.Kind == jobMove
+	q.mu.Unlock()
+	notifyUI()
+	var total int64
+	sizes := make([]int64, len(j.Files))
+	for i, f := range j.Files {
+		// Moves only copy across file systems
+		if j.Kind == jobCopy || (j.Kind == jobMove && !SameDevice(f, j.Dst)) {
+			q.mu.Lock()
+			j.Current = i
+			q.mu.Unlock()
+			notifyUI()
+			sizes[i] = treeSize(j.ctx, f)
+			total += sizes[i]
+		}
+	}
+	q.mu.Lock()
+	j.Scanning = false
+	j.TotalBytes = total
+	j.Started = time.Now()
+	q.mu.Unlock()
+
+	cb := &OpCallbacks{
+		Progress: func(file string, n int64) {
+			q.mu.Lock()
+			if n == 0 {
+				j.CurrentFile = file
+			}
+			j.DoneBytes += n
+			j.Copied += n
+			q.mu.Unlock()
+			notifyUI()
+		},
+		Conflict: j.askConflict,
+		Created: func(src string, dst string) {
+			kind := undoCopy
+			if j.Kind == jobMove {
+				kind = undoMove
+			}
+			j.records = append(j.records, newUndoRecord(kind, src, dst))
+		},
+		Overwritten: func(dst string) {
+			j.overwritten++
+		},
+	}
+	var errs []string
+	var done int64
+	for i := range j.Files {
+		if j.ctx.Err() != nil {
+			// Stopped between files: mark the rest as not done
+			q.mu.Lock()
+			for k := i; k < len(j.Files); k++ {
+				j.Errs[k] = ErrCancelled
+			}
+			q.mu.Unlock()
+			break
+		}
+		q.mu.Lock()
+		j.Current = i
+		j.CurrentFile = ""
+		q.mu.Unlock()
+		notifyUI()
+		err := j.runFile(i, cb)
+		if err != nil && err != ErrCancelled {
+			Logf("Job %d: %s\n", j.ID, err)
+			errs = append(errs, err.Error())
+		}
+		// Renames and failures don't report progress, so resync
+		// the byte count once each entry is finished
+		done += sizes[i]
+		q.mu.Lock()
+		j.Errs[i] = err
+		j.DoneBytes = done
+		q.mu.Unlock()
+	}
+	q.mu.Lock()
+	if j.ctx.Err() != nil {
+		j.State = jobCancelled
+		errs = append([]string{fmt.Sprintf("%s cancelled.", j.Description())}, errs...)
+	} else if len(errs) > 0 {
+		j.State = jobFailed
+	} else {
+		j.State = jobDone
+	}
+	if len(errs) > 0 {
+		j.Err = fmt.Errorf("%s", strings.Join(errs, " "))
+	}
+	q.mu.Unlock()
+}
+
+// Cancel stops the job with the given ID if it's pending or running
+func (q *JobQueue) Cancel(id int) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for _, j := range q.jobs {
+		if j.ID == id && !j.Finished() {
+			j.cancel()
+		}
+	}
+}
+
+// CancelAll stops all the pending and running jobs
+func (q *JobQueue) CancelAll() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for _, j := range q.jobs {
+		if !j.Finished() {
+			j.cancel()
+		}
+	}
+}
+
+// Wait blocks until all jobs are finished
+func (q *JobQueue) Wait() {
+	q.active.Wait()
+}
+
+// List returns a snapshot of all the jobs
+func (q *JobQueue) List() []Job {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	list := make([]Job, len(q.jobs))
+	for i, j := range q.jobs {
+		list[i] = *j
+	}
+	return list
+}
+
+// Active returns the number of pending and running jobs
+func (q *JobQueue) Active() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	n := 0
+	for _, j := range q.jobs {
+		if j.State == jobPending || j.State == jobRunning {
+			n++
+		}
+	}
+	return n
+}
+
+// Summary returns the progress of the running jobs for the status line,
+// or an empty string if no jobs are active
+func (q *JobQueue) Summary() string {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	var running []string
+	pending := 0
+	for _, j := range q.jobs {
+		if j.State == jobRunning {
+			running = append(running, j.Progress())
+		} else if j.State == jobPending {
+			pending++
+		}
+	}
+	s := strings.Join(running, " | ")
+	if pending > 0 {
+		s += fmt.Sprintf(" (+%d queued)", pending)
+	}
+	return s
+}
+
+// TakeFinished returns the jobs that completed since the last call
+func (q *JobQueue) TakeFinished() []*Job {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	var finished []*Job
+	for _, j := range q.jobs {
+		if !j.handled && j.Finished() {
+			j.handled = true
+			finished = append(finished, j)
+		}
+	}
+	return finished
+}
+
+// ClearFinished forgets all completed jobs
+func (q *JobQueue) ClearFinished() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	var list []*Job
+	for _, j := range q.jobs {
+		if !j.handled {
+			list = append(list, j)
+		}
+	}
+	q.jobs = list
+}
+
+// ------------------
+
+// conflictView asks what to do when the target of a copy or move exists
+type conflictView struct {
+	req *conflictRequest
+	all bool
+}
+
+func describeFile(info os.FileInfo) string {
+	return fmt.Sprintf("%s (%d bytes), modified %s", bytefmt.ByteSize(uint64(info.Size())), info.Size(), info.ModTime().Format("02 Jan 2006 15:04:05"))
+}
+
+func (v *conflictView) Render(w, h int) {
+	bw := w - 4
+	if bw > 100 {
+		bw = 100
+	}
+	x, y := (w-bw)/2, h/2-5
+	drawBox(x, y, bw, 9, "File already exists")
+	srcDesc, dstDesc := describeFile(v.req.SrcInfo), describeFile(v.req.DstInfo)
+	if v.req.SrcInfo.ModTime().After(v.req.DstInfo.ModTime()) {
+		srcDesc += " (newer)"
+	} else if v.req.DstInfo.ModTime().After(v.req.SrcInfo.ModTime()) {
+		dstDesc += " (newer)"
+	}
+	const coldef = termbox.ColorDefault
+	tbprintw(x+2, y+1, bw-4, termbox.ColorYellow, coldef, v.req.Job.Kind.Verb()+":")
+	tbprintw(x+4, y+2, bw-6, coldef, coldef, v.req.Src)
+	tbprintw(x+4, y+3, bw-6, coldef, coldef, srcDesc)
+	tbprintw(x+2, y+4, bw-4, termbox.ColorYellow, coldef, "Over existing:")
+	tbprintw(x+4, y+5, bw-6, coldef, coldef, v.req.Dst)
+	tbprintw(x+4, y+6, bw-6, coldef, coldef, dstDesc)
+	all := "off"
+	if v.all {
+		all = "ON"
+	}
+	tbprintw(x+2, y+8, bw-4, termbox.ColorWhite|termbox.AttrBold, coldef, "[o] Overwrite  [s] Skip  [r] Rename  [n] Overwrite if newer  [a] Apply to all: "+all)
+}
+
+func (v *conflictView) HandleKey(ev termbox.Event) bool {
+	r := conflictReply{All: v.all}
+	switch {
+	case ev.Key == termbox.KeyEsc:
+		r.Cancel = true
+	case ev.Ch == 'o' || ev.Ch == 'O':
+		r.Action = ConflictOverwrite
+	case ev.Ch == 's' || ev.Ch == 'S':
+		r.Action = ConflictSkip
+	case ev.Ch == 'r' || ev.Ch == 'R':
+		r.Action = ConflictRename
+	case ev.Ch == 'n' || ev.Ch == 'N':
+		r.Action = ConflictOverwriteNewer
+	case ev.Ch == 'a' || ev.Ch == 'A':
+		v.all = !v.all
+		return true
+	default:
+		return true
+	}
+	v.req.reply <- r
+	return false
+}
+
+func (v *conflictView) Help() string {
+	return "[o Overwrite] [s Skip] [r Rename] [n Overwrite if newer] [a Apply to all] [ESC Cancel job]"
+}
+
+// showConflicts opens a dialog for the next pending conflict, if any,
+// and closes the dialog of a conflict whose job was cancelled meanwhile
+func showConflicts() {
+	for _, view := range views {
+		if cv, ok := view.(*conflictView); ok {
+			if cv.req.Job.ctx.Err() == nil {
+				return
+			}
+			closeView(cv)
+			break
+		}
+	}
+	for {
+		select {
+		case req := <-conflicts:
+			if req.Job.ctx.Err() == nil {
+				pushView(&conflictView{req: req})
+				return
+			}
+		default:
+			return
+		}
+	}
+}
+
+// jobsView lists all the jobs and their state
+type jobsView struct {
+	top    int
+	cursor int
+}
+
+func (v *jobsView) Render(w, h int) {
+	list := jobs.List()
+	h -= 2
+	drawBox(0, 0, w, h, "Jobs")
+	rows := h - 1
+	if v.cursor >= len(list) {
+		v.cursor = len(list) - 1
+	}
+	if v.cursor < 0 {
+		v.cursor = 0
+	}
+	if v.cursor < v.top {
+		v.top = v.cursor
+	} else if v.cursor >= v.top+rows {
+		v.top = v.cursor - rows + 1
+	}
+	for i := 0; i < rows && v.top+i < len(list); i++ {
+		j := &list[v.top+i]
+		fg, bg := termbox.ColorDefault, termbox.ColorDefault
+		switch j.State {
+		case jobRunning:
+			fg = termbox.ColorCyan
+		case jobDone:
+			fg = termbox.ColorGreen
+		case jobFailed:
+			fg = termbox.ColorRed
+		case jobCancelled:
+			fg = termbox.ColorMagenta
+		}
+		if v.top+i == v.cursor {
+			fg, bg = termbox.ColorBlack, termbox.ColorGreen
+		}
+		s := fmt.Sprintf("%4d %-8s %s", j.ID, j.State, j.Description())
+		if j.State == jobRunning || j.State == jobFailed || j.State == jobCancelled {
+			s += ": " + j.Progress()
+		}
+		fill(0, 1+i, w, 1, termbox.Cell{Ch: ' ', Bg: bg})
+		tbprintw(0, 1+i, w, fg, bg, s)
+	}
+	if len(list) == 0 {
+		tbprint(1, 1, termbox.ColorDefault, termbox.ColorDefault, "No jobs")
+	}
+}
+
+func (v *jobsView) Help() string {
+	return "[ESC,q,J close] [ARROWS nav] [x Cancel job] [C clear finished]"
+}
+
+func (v *jobsView) HandleKey(ev termbox.Event) bool {
+	if ev.Key == termbox.KeyEsc || ev.Ch == 'q' || ev.Ch == 'J' {
+		return false
+	} else if ev.Key == termbox.KeyArrowUp || ev.Ch == 'k' {
+		v.cursor--
+	} else if ev.Key == termbox.KeyArrowDown || ev.Ch == 'j' {
+		v.cursor++
+	} else if ev.Key == termbox.KeyHome {
+		v.cursor = 0
+	} else if ev.Key == termbox.KeyEnd {
+		v.cursor = len(jobs.List()) - 1
+	} else if ev.Ch == 'C' {
+		jobs.ClearFinished()
+	} else if ev.Ch == 'x' || ev.Key == termbox.KeyDelete {
+		list := jobs.List()
+		if v.cursor >= 0 && v.cursor < len(list) && !list[v.cursor].Finished() {
+			id := list[v.cursor].ID
+			pushView(&confirmView{
+				Prompt: fmt.Sprintf("Cancel job %d (%s)?", id, list[v.cursor].Description()),
+				OnYes:  func() { jobs.Cancel(id) },
+			})
+		}
+	}
+	return true
+}
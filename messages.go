@@ -0,0 +1,377 @@
+// Copyright 2017 Javier Arevalo <jare@iguanademos.com>
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+// http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Messages: the output of the commands run and the errors of the file
+// operations, kept so they can be read in full after the status line
+// has moved on
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/nsf/termbox-go"
+)
+
+// The oldest messages are dropped when there are more lines than this
+const maxMessageLines = 100000
+
+type textLine struct {
+	Text string
+	Fg   termbox.Attribute
+}
+
+// messageLog holds the messages. Messages can be added from any goroutine
+type messageLog struct {
+	mu    sync.Mutex
+	lines []textLine
+}
+
+var messages messageLog
+
+// Add records a message: a title with the time, followed by its lines
+func (l *messageLog) Add(title string, lines []string, failed bool) {
+	fg := termbox.ColorGreen | termbox.AttrBold
+	if failed {
+		fg = termbox.ColorRed | termbox.AttrBold
+	}
+	l.mu.Lock()
+	l.lines = append(l.lines, textLine{time.Now().Format("15:04:05 ") + title, fg})
+	for _, s := range lines {
+		l.lines = append(l.lines, textLine{s, termbox.ColorDefault})
+	}
+	if n := len(l.lines); n > maxMessageLines {
+		l.lines = append([]textLine(nil), l.lines[n-maxMessageLines:]...)
+	}
+	l.mu.Unlock()
+	notifyUI()
+}
+
+// Lines returns the lines of all the messages. Lines are only added
+// at the end, so the slice returned stays valid
+func (l *messageLog) Lines() []textLine {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.lines
+}
+
+// errorLines returns the messages of errors, with each error of a
+// FileErrors in its own line. Cancellations are left out
+func errorLines(errs ...error) []string {
+	var lines []string
+	for _, err := range errs {
+		if fe, ok := err.(FileErrors); ok {
+			for _, e := range fe {
+				lines = append(lines, e.Error())
+			}
+		} else if err != nil && err != ErrCancelled {
+			lines = append(lines, err.Error())
+		}
+	}
+	return lines
+}
+
+// ------------------
+
+// scrollText shows lines of text in a box, scrolling through them and
+// searching them. The lines can grow while it's shown
+type scrollText struct {
+	lines []textLine
+	top   int
+	// Keep showing the last lines as they come
+	follow bool
+	// Rows shown in the last render
+	rows int
+	// Not nil while the search text is typed in the status line
+	editor      *LineEditor
+	search      []byte
+	fold        bool
+	searchStart int
+	// Line of the current match, or -1
+	match    int
+	notFound bool
+}
+
+func newScrollText(follow bool) *scrollText {
+	return &scrollText{follow: follow, match: -1}
+}
+
+// SetLines changes the lines shown, usually the same ones with more
+// at the end
+func (t *scrollText) SetLines(lines []textLine) {
+	t.lines = lines
+}
+
+// Render draws the box, with the title on top, over the whole screen
+// but the status line
+func (t *scrollText) Render(title string, w, h int) {
+	h -= 2
+	drawBox(0, 0, w, h, title)
+	t.rows = h - 1
+	if last := len(t.lines) - t.rows; t.follow || t.top > last {
+		t.top = last
+	}
+	if t.top < 0 {
+		t.top = 0
+	}
+	for i := 0; i < t.rows && t.top+i < len(t.lines); i++ {
+		t.renderLine(1+i, w, t.lines[t.top+i], t.top+i == t.match)
+	}
+}
+
+func (t *scrollText) renderLine(y, w int, line textLine, current bool) {
+	text := []byte(line.Text)
+	marks := t.highlights(text)
+	for _, c := range layoutLine(text) {
+		if c.col+c.width > w {
+			break
+		}
+		fg, bg := line.Fg, termbox.ColorDefault
+		if c.special {
+			fg = termbox.ColorCyan
+		}
+		if marks != nil && marks[c.off] {
+			fg, bg = termbox.ColorBlack, termbox.ColorYellow
+			if current {
+				bg = termbox.ColorGreen
+			}
+		}
+		termbox.SetCell(c.col, y, c.ch, fg, bg)
+	}
+}
+
+// RenderStatus draws the search being typed, or else help
+func (t *scrollText) RenderStatus(y, w int, help string) {
+	if t.editor == nil {
+		tbprintw(0, y, w, termbox.ColorDefault, termbox.ColorDefault, help)
+		return
+	}
+	x := tbprint(0, y, termbox.ColorYellow|termbox.AttrBold, termbox.ColorDefault, "Search: ")
+	hint := ""
+	if t.notFound {
+		hint = " not found"
+	}
+	ew := w - x - len(hint)
+	tbprint(x+ew, y, termbox.ColorRed, termbox.ColorDefault, hint)
+	t.editor.Render(x, y, ew, termbox.ColorWhite, termbox.ColorBlue, true)
+}
+
+// HandleKey processes the keys that scroll and search, returning
+// false if the key is not one of them
+func (t *scrollText) HandleKey(ev termbox.Event) bool {
+	if t.editor != nil {
+		t.handleEditKey(ev)
+		return true
+	}
+	last := len(t.lines) - t.rows
+	switch {
+	case ev.Ch == '/':
+		t.editor = NewLineEditor("")
+		t.searchStart = t.top
+		t.setSearch("")
+		return true
+	case ev.Ch == 'n':
+		t.next(1)
+		return true
+	case ev.Ch == 'N':
+		t.next(-1)
+		return true
+	case ev.Key == termbox.KeyArrowUp || ev.Ch == 'k':
+		t.top--
+	case ev.Key == termbox.KeyArrowDown || ev.Ch == 'j':
+		t.top++
+	case ev.Key == termbox.KeyPgup || ev.Ch == 'u':
+		t.top -= t.rows - 1
+	case ev.Key == termbox.KeyPgdn || ev.Ch == 'i' || ev.Key == termbox.KeySpace:
+		t.top += t.rows - 1
+	case ev.Key == termbox.KeyHome || ev.Ch == 'U':
+		t.top = 0
+	case ev.Key == termbox.KeyEnd || ev.Ch == 'I':
+		t.top = last
+	default:
+		return false
+	}
+	if t.top < 0 {
+		t.top = 0
+	}
+	// Scrolling to the end follows the lines again
+	t.follow = t.top >= last
+	return true
+}
+
+func (t *scrollText) handleEditKey(ev termbox.Event) {
+	switch ev.Key {
+	case termbox.KeyEsc:
+		t.setSearch("")
+		t.top = t.searchStart
+		t.editor = nil
+		return
+	case termbox.KeyEnter:
+		t.editor = nil
+		return
+	}
+	if !t.editor.HandleKey(ev) {
+		return
+	}
+	// Incremental search from where it started
+	t.setSearch(t.editor.Text())
+	if len(t.search) == 0 {
+		t.top = t.searchStart
+		return
+	}
+	// Wrapping around, as the view usually starts at the end
+	i := t.find(t.searchStart, 1)
+	if i < 0 {
+		i = t.find(0, 1)
+	}
+	if i >= 0 {
+		t.showMatch(i)
+	} else {
+		t.notFound = true
+	}
+}
+
+// setSearch changes the text searched. It ignores case unless it has
+// uppercase letters
+func (t *scrollText) setSearch(text string) {
+	t.search = []byte(text)
+	t.fold = strings.ToLower(text) == text
+	if t.fold {
+		t.search = lowerASCII(t.search)
+	}
+	t.match = -1
+	t.notFound = false
+}
+
+// next goes to the next match after the current one, or the previous
+// one if dir is -1
+func (t *scrollText) next(dir int) {
+	if len(t.search) == 0 {
+		status = "Press / to search"
+		return
+	}
+	from := t.top
+	if t.match >= 0 {
+		from = t.match + dir
+	}
+	if i := t.find(from, dir); i >= 0 {
+		t.showMatch(i)
+	} else {
+		status = "Text not found"
+	}
+}
+
+// find returns the first line from line from on, going in direction
+// dir, that contains the search, or -1 if none does
+func (t *scrollText) find(from, dir int) int {
+	for i := from; i >= 0 && i < len(t.lines); i += dir {
+		if t.highlights([]byte(t.lines[i].Text)) != nil {
+			return i
+		}
+	}
+	return -1
+}
+
+// showMatch makes line i the current match and scrolls to show it
+func (t *scrollText) showMatch(i int) {
+	t.match = i
+	t.follow = false
+	if i < t.top || i >= t.top+t.rows {
+		t.top = i - t.rows/3
+	}
+	if t.top < 0 {
+		t.top = 0
+	}
+}
+
+// highlights marks the bytes of a line that match the search, or
+// returns nil if there are none
+func (t *scrollText) highlights(line []byte) []bool {
+	if len(t.search) == 0 {
+		return nil
+	}
+	data := line
+	if t.fold {
+		data = lowerASCII(append([]byte(nil), line...))
+	}
+	var marks []bool
+	for start := 0; ; {
+		i := bytes.Index(data[start:], t.search)
+		if i < 0 {
+			break
+		}
+		if marks == nil {
+			marks = make([]bool, len(data))
+		}
+		for k := start + i; k < start+i+len(t.search); k++ {
+			marks[k] = true
+		}
+		start += i + len(t.search)
+	}
+	return marks
+}
+
+// ------------------
+
+// messagesView shows the message log
+type messagesView struct {
+	text *scrollText
+}
+
+func showMessages() {
+	pushView(&messagesView{text: newScrollText(true)})
+}
+
+func (v *messagesView) Render(w, h int) {
+	lines := messages.Lines()
+	v.text.SetLines(lines)
+	v.text.Render("Messages", w, h)
+	if len(lines) == 0 {
+		tbprint(0, 1, termbox.ColorCyan, termbox.ColorDefault, "(no messages)")
+	}
+}
+
+func (v *messagesView) RenderStatus(y, w int) {
+	v.text.RenderStatus(y, w, v.Help())
+}
+
+func (v *messagesView) HandleKey(ev termbox.Event) bool {
+	v.text.SetLines(messages.Lines())
+	if v.text.HandleKey(ev) {
+		return true
+	}
+	return !(ev.Key == termbox.KeyEsc || ev.Ch == 'q' || ev.Ch == 'O')
+}
+
+func (v *messagesView) Help() string {
+	return "[ESC,q,O close] [ARROWS scroll] [/ Search] [n/N Next/previous match]"
+}
+
+// reportErrors records the errors of an operation in the messages,
+// and returns a short text for the status line pointing to them
+func reportErrors(what string, errs ...error) string {
+	lines := errorLines(errs...)
+	if len(lines) == 0 {
+		return ""
+	}
+	messages.Add(what, lines, true)
+	if len(lines) == 1 {
+		return fmt.Sprintf("%s: %s (O shows the messages)", what, lines[0])
+	}
+	return fmt.Sprintf("%s: %d errors, press O to see them", what, len(lines))
+}
@@ -0,0 +1,297 @@
+// Copyright 2017 Javier Arevalo <jare@iguanademos.com>
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+// http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Opening files with the programs associated to them
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"mime"
+	"net/http"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"runtime"
+	"strings"
+)
+
+// association tells how to open the files matching Pattern, which is a
+// glob for the file name like "*.pdf", or a MIME type like "image/*".
+// Command is split in words like a shell would, and the placeholders
+// in it are replaced by the file (see expandArgs). Background commands
+// are left running on their own, others take the terminal until they end
+type association struct {
+	Pattern    string
+	Command    string
+	Background bool
+}
+
+var associations []association
+
+// Match returns whether the file matches the pattern of the association
+func (a *association) Match(name string, mimeType func() string) bool {
+	return matchPattern(a.Pattern, name, mimeType)
+}
+
+// matchPattern checks a file against a glob for its name, or a MIME
+// type if the pattern has a /, ignoring case
+func matchPattern(pattern string, name string, mimeType func() string) bool {
+	if strings.Contains(pattern, "/") {
+		ok, _ := path.Match(strings.ToLower(pattern), mimeType())
+		return ok
+	}
+	ok, _ := filepath.Match(strings.ToLower(pattern), strings.ToLower(filepath.Base(name)))
+	return ok
+}
+
+// mimeTypeOf guesses the MIME type of a file, without parameters,
+// from its extension or else from its contents
+func mimeTypeOf(name string) string {
+	t := mime.TypeByExtension(filepath.Ext(name))
+	if t == "" {
+		head := make([]byte, 512)
+		if f, err := os.Open(name); err == nil {
+			n, _ := f.Read(head)
+			f.Close()
+			t = http.DetectContentType(head[:n])
+		}
+	}
+	if i := strings.IndexByte(t, ';'); i >= 0 {
+		t = t[:i]
+	}
+	return strings.ToLower(strings.TrimSpace(t))
+}
+
+// findAssociation returns the first association that matches the file
+func findAssociation(name string) *association {
+	mimeType := ""
+	lazyMime := func() string {
+		if mimeType == "" {
+			mimeType = mimeTypeOf(name)
+		}
+		return mimeType
+	}
+	for i := range associations {
+		if associations[i].Match(name, lazyMime) {
+			return &associations[i]
+		}
+	}
+	return nil
+}
+
+// ------------------
+
+// splitCommandLine splits a command line in words like a POSIX shell
+// does, with '...' and "..." quotes and \ escapes, but nothing else.
+// On Windows \ separates folders, so it doesn't escape
+func splitCommandLine(s string) ([]string, error) {
+	escapes := runtime.GOOS != "windows"
+	var words []string
+	var word strings.Builder
+	inWord := false
+	quote := rune(0)
+	escaped := false
+	for _, c := range s {
+		switch {
+		case escaped:
+			word.WriteRune(c)
+			escaped = false
+		case quote == '\'':
+			if c == '\'' {
+				quote = 0
+			} else {
+				word.WriteRune(c)
+			}
+		case c == '\\' && quote == '"' && escapes:
+			escaped = true
+		case quote == '"':
+			if c == '"' {
+				quote = 0
+			} else {
+				word.WriteRune(c)
+			}
+		case c == '\\' && escapes:
+			escaped, inWord = true, true
+		case c == '\'' || c == '"':
+			quote, inWord = c, true
+		case c == ' ' || c == '\t' || c == '\n':
+			if inWord {
+				words = append(words, word.String())
+				word.Reset()
+				inWord = false
+			}
+		default:
+			word.WriteRune(c)
+			inWord = true
+		}
+	}
+	if quote != 0 || escaped {
+		return nil, errors.New("Unterminated quote in command " + s)
+	}
+	if inWord {
+		words = append(words, word.String())
+	}
+	return words, nil
+}
+
+// expandArgs replaces the placeholders % followed by a letter in the
+// words of a command with their values. A word that is just a placeholder
+// with several values becomes one word for each value; inside a longer
+// word the values are joined with spaces. %% is a literal %
+func expandArgs(words []string, vars map[byte][]string) []string {
+	var args []string
+	for _, w := range words {
+		if len(w) == 2 && w[0] == '%' {
+			if values, ok := vars[w[1]]; ok {
+				args = append(args, values...)
+				continue
+			}
+		}
+		args = append(args, expandPlaceholders(w, func(c byte) (string, bool) {
+			values, ok := vars[c]
+			return strings.Join(values, " "), ok
+		}))
+	}
+	return args
+}
+
+// expandPlaceholders replaces the % placeholders of s with the
+// values returned by value. Unknown placeholders are left as they are
+func expandPlaceholders(s string, value func(c byte) (string, bool)) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] != '%' || i+1 == len(s) {
+			b.WriteByte(s[i])
+			continue
+		}
+		if s[i+1] == '%' {
+			b.WriteByte('%')
+			i++
+		} else if v, ok := value(s[i+1]); ok {
+			b.WriteString(v)
+			i++
+		} else {
+			b.WriteByte('%')
+		}
+	}
+	return b.String()
+}
+
+// fileVars returns the values of the placeholders for a single file:
+// %f the file, %d the folder it's in and %n its name
+func fileVars(name string) map[byte][]string {
+	return map[byte][]string{
+		'f': {name},
+		'd': {filepath.Dir(name)},
+		'n': {filepath.Base(name)},
+	}
+}
+
+// ------------------
+
+// startDetached runs a program in the background, without access to the
+// terminal, and leaves it running after jm exits
+func startDetached(args []string, dir string) error {
+	cmd := exec.Command(args[0], args[1:]...)
+	cmd.Dir = dir
+	DetachCommand(cmd)
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	// Collect its exit status so it doesn't stay as a zombie
+	go cmd.Wait()
+	return nil
+}
+
+// runForeground runs a program with the terminal and waits for it to end
+func runForeground(args []string, dir string) error {
+	return runSuspended(func() error {
+		cmd := exec.Command(args[0], args[1:]...)
+		cmd.Dir = dir
+		cmd.Stdin, cmd.Stdout, cmd.Stderr = os.Stdin, os.Stdout, os.Stderr
+		return cmd.Run()
+	})
+}
+
+// openFile opens a file with the program associated to it in the config
+// file, or else with the system's default program for it. If there's
+// no way to open it, it's shown in the viewer
+func openFile(name string) {
+	var args []string
+	a := findAssociation(name)
+	if a != nil {
+		words, err := splitCommandLine(a.Command)
+		if err != nil {
+			status = err.Error()
+			return
+		}
+		args = expandArgs(words, fileVars(name))
+	} else if opener := OpenerCommand(); opener != nil {
+		args = append(opener, name)
+		a = &association{Background: true}
+	} else {
+		openViewer(name)
+		return
+	}
+	if len(args) == 0 {
+		status = fmt.Sprintf("Empty command to open %s", filepath.Base(name))
+		return
+	}
+	var err error
+	dir := filepath.Dir(name)
+	if a.Background {
+		err = startDetached(args, dir)
+	} else {
+		err = runForeground(args, dir)
+		ap.Refresh()
+		op.Refresh()
+	}
+	if err != nil {
+		status = fmt.Sprintf("Running %s failed: %s", args[0], err)
+	} else if a.Background {
+		status = fmt.Sprintf("Opened %s with %s", filepath.Base(name), args[0])
+	}
+}
+
+// editFile opens the file at the cursor in the user's text editor
+func editFile() {
+	runOnCursorFile(RunEditor)
+}
+
+// pageFile shows the file at the cursor in the user's pager
+func pageFile() {
+	runOnCursorFile(RunPager)
+}
+
+// runOnCursorFile runs a program on the file at the cursor, giving it
+// the terminal, and refreshes the panels when it exits
+func runOnCursorFile(run func(file string) error) {
+	if ap.Cursor >= len(ap.Entries) {
+		return
+	}
+	e := ap.Entries[ap.Cursor]
+	if e.IsDir() {
+		status = e.Name() + " is a folder"
+		return
+	}
+	name := ap.Path(e)
+	if err := runSuspended(func() error { return run(name) }); err != nil {
+		status = err.Error()
+	}
+	ap.Refresh()
+	op.Refresh()
+}
@@ -0,0 +1,126 @@
+// Copyright 2017 Javier Arevalo <jare@iguanademos.com>
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+// http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"reflect"
+	"runtime"
+	"testing"
+)
+
+func TestSplitCommandLine(t *testing.T) {
+	tests := []struct {
+		line string
+		want []string
+		// Uses \ escapes, which Windows doesn't have
+		escapes bool
+	}{
+		{"vim", []string{"vim"}, false},
+		{"  vim  -R\t%f ", []string{"vim", "-R", "%f"}, false},
+		{"", nil, false},
+		{`mpv "my file.mp4"`, []string{"mpv", "my file.mp4"}, false},
+		{`echo 'it''s'`, []string{"echo", "its"}, false},
+		{`echo "it's"`, []string{"echo", "it's"}, false},
+		{`echo 'say "hi"'`, []string{"echo", `say "hi"`}, false},
+		{`echo '$HOME' '` + "`id`" + `'`, []string{"echo", "$HOME", "`id`"}, false},
+		{"echo 'two\nlines'", []string{"echo", "two\nlines"}, false},
+		{`echo ""`, []string{"echo", ""}, false},
+		{`echo a"b c"d`, []string{"echo", "ab cd"}, false},
+		{`echo my\ file`, []string{"echo", "my file"}, true},
+		{`echo it\'s`, []string{"echo", "it's"}, true},
+		{`echo "a\"b"`, []string{"echo", `a"b`}, true},
+		{`echo 'a\b'`, []string{"echo", `a\b`}, true},
+		{`echo 'it'\''s'`, []string{"echo", "it's"}, true},
+	}
+	for _, tt := range tests {
+		if tt.escapes && runtime.GOOS == "windows" {
+			continue
+		}
+		got, err := splitCommandLine(tt.line)
+		if err != nil {
+			t.Errorf("%q: unexpected error: %s", tt.line, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%q: got %q, want %q", tt.line, got, tt.want)
+		}
+	}
+}
+
+func TestSplitCommandLineErrors(t *testing.T) {
+	for _, line := range []string{`echo 'open`, `echo "open`, `echo open\`} {
+		if runtime.GOOS == "windows" && line[len(line)-1] == '\\' {
+			continue
+		}
+		if words, err := splitCommandLine(line); err == nil {
+			t.Errorf("%q: expected an error, got %q", line, words)
+		}
+	}
+}
+
+func TestExpandArgs(t *testing.T) {
+	vars := map[byte][]string{
+		'f': {"my file.txt"},
+		'F': {"a b", "it's", "$x"},
+		'd': {"/home/me"},
+		'n': nil,
+	}
+	tests := []struct {
+		words []string
+		want  []string
+	}{
+		{[]string{"vim", "%f"}, []string{"vim", "my file.txt"}},
+		{[]string{"tar", "czf", "x.tgz", "%F"}, []string{"tar", "czf", "x.tgz", "a b", "it's", "$x"}},
+		{[]string{"echo", "[%F]"}, []string{"echo", "[a b it's $x]"}},
+		{[]string{"cp", "%f", "%d/backup"}, []string{"cp", "my file.txt", "/home/me/backup"}},
+		{[]string{"echo", "%n"}, []string{"echo"}},
+		{[]string{"echo", "100%%", "%z", "50%"}, []string{"echo", "100%", "%z", "50%"}},
+	}
+	for _, tt := range tests {
+		got := expandArgs(tt.words, vars)
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%q: got %q, want %q", tt.words, got, tt.want)
+		}
+	}
+}
+
+func TestExpandPlaceholders(t *testing.T) {
+	value := func(c byte) (string, bool) {
+		switch c {
+		case 'f':
+			return "file", true
+		case 'e':
+			return "", true
+		}
+		return "", false
+	}
+	tests := []struct {
+		s, want string
+	}{
+		{"", ""},
+		{"plain", "plain"},
+		{"%f", "file"},
+		{"<%f><%e>", "<file><>"},
+		{"%%f", "%f"},
+		{"%%%f", "%file"},
+		{"%x %", "%x %"},
+		{"%f%f", "filefile"},
+	}
+	for _, tt := range tests {
+		if got := expandPlaceholders(tt.s, value); got != tt.want {
+			t.Errorf("%q: got %q, want %q", tt.s, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,338 @@
+// Copyright 2017 Javier Arevalo <jare@iguanademos.com>
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+// http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Reading large files in pages, to view them without loading them
+// fully in memory
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"sync"
+)
+
+const filePageSize = 64 * 1024
+
+// Up to 16MB of each file is kept in memory
+const maxFilePages = 256
+
+// pagedFile reads a file through a cache of pages. It is safe to use
+// from several goroutines
+type pagedFile struct {
+	mu    sync.Mutex
+	f     *os.File
+	size  int64
+	pages map[int64]*filePage
+	tick  int64
+}
+
+type filePage struct {
+	data []byte
+	used int64
+}
+
+func openPagedFile(path string) (*pagedFile, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	st, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	if st.IsDir() {
+		f.Close()
+		return nil, fmt.Errorf("%s is a folder", path)
+	}
+	return &pagedFile{f: f, size: st.Size(), pages: make(map[int64]*filePage)}, nil
+}
+
+// Size returns the size of the file when it was opened
+func (p *pagedFile) Size() int64 {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.size
+}
+
+// page returns the contents of page n, reading it if it's not cached.
+// Must be called with the lock held
+func (p *pagedFile) page(n int64) ([]byte, error) {
+	p.tick++
+	if pg, ok := p.pages[n]; ok {
+		pg.used = p.tick
+		return pg.data, nil
+	}
+	if len(p.pages) >= maxFilePages {
+		// Forget the least recently used page
+		oldest, oldestUsed := int64(-1), p.tick
+		for k, pg := range p.pages {
+			if pg.used < oldestUsed {
+				oldest, oldestUsed = k, pg.used
+			}
+		}
+		delete(p.pages, oldest)
+	}
+	data := make([]byte, filePageSize)
+	got, err := p.f.ReadAt(data, n*filePageSize)
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+	data = data[:got]
+	p.pages[n] = &filePage{data, p.tick}
+	return data, nil
+}
+
+// ReadAt reads from the file through the page cache, like io.ReaderAt.
+// The file is considered to end at Size
+func (p *pagedFile) ReadAt(buf []byte, off int64) (int, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	n := 0
+	for n < len(buf) {
+		pos := off + int64(n)
+		if pos >= p.size {
+			return n, io.EOF
+		}
+		data, err := p.page(pos / filePageSize)
+		if err != nil {
+			return n, err
+		}
+		start := int(pos % filePageSize)
+		if start >= len(data) {
+			return n, io.EOF
+		}
+		n += copy(buf[n:], data[start:])
+	}
+	return n, nil
+}
+
+// readDirect reads bypassing the cache, for long sequential reads
+// that would evict the pages being viewed
+func (p *pagedFile) readDirect(buf []byte, off int64) (int, error) {
+	size := p.Size()
+	if off >= size {
+		return 0, io.EOF
+	}
+	if int64(len(buf)) > size-off {
+		buf = buf[:size-off]
+	}
+	return p.f.ReadAt(buf, off)
+}
+
+// Refresh checks if the file grew or shrank, forgetting the cached
+// pages that may have changed. Returns the new and the previous size
+func (p *pagedFile) Refresh() (int64, int64, error) {
+	st, err := p.f.Stat()
+	if err != nil {
+		return 0, 0, err
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	old := p.size
+	if st.Size() > old {
+		// The last page may have been read partially
+		delete(p.pages, old/filePageSize)
+	} else if st.Size() < old {
+		p.pages = make(map[int64]*filePage)
+	}
+	p.size = st.Size()
+	return p.size, old, nil
+}
+
+// Replaced checks if path is no longer the file that was opened,
+// like when a log file is rotated
+func (p *pagedFile) Replaced(path string) bool {
+	st, err := os.Stat(path)
+	if err != nil {
+		// Wait for the new file to appear
+		return false
+	}
+	cur, err := p.f.Stat()
+	return err == nil && !os.SameFile(st, cur)
+}
+
+// Close closes the file
+func (p *pagedFile) Close() error {
+	return p.f.Close()
+}
+
+// ------------------
+
+// A checkpoint is recorded every this many lines
+const linesPerCheckpoint = 1024
+
+// lineIndex counts the lines of a file in the background, recording
+// where every linesPerCheckpoint-th line starts, so line numbers can be
+// found without reading the whole file
+type lineIndex struct {
+	file   *pagedFile
+	ctx    context.Context
+	cancel context.CancelFunc
+	mu     sync.Mutex
+	// Offset of lines 0, linesPerCheckpoint, 2*linesPerCheckpoint...
+	checkpoints []int64
+	// Newlines found in the bytes scanned
+	lines   int64
+	scanned int64
+	last    byte
+	done    bool
+}
+
+func newLineIndex(file *pagedFile) *lineIndex {
+	x := &lineIndex{file: file, checkpoints: []int64{0}}
+	x.ctx, x.cancel = context.WithCancel(context.Background())
+	go x.run()
+	return x
+}
+
+func (x *lineIndex) run() {
+	buf := make([]byte, 1024*1024)
+	for x.ctx.Err() == nil {
+		x.mu.Lock()
+		pos := x.scanned
+		x.mu.Unlock()
+		n, err := x.file.readDirect(buf, pos)
+		x.mu.Lock()
+		data := buf[:n]
+		for {
+			i := bytes.IndexByte(data, '\n')
+			if i < 0 {
+				break
+			}
+			x.lines++
+			if x.lines%linesPerCheckpoint == 0 {
+				x.checkpoints = append(x.checkpoints, pos+int64(i)+1)
+			}
+			pos += int64(i) + 1
+			data = data[i+1:]
+		}
+		x.scanned += int64(n)
+		if n > 0 {
+			x.last = buf[n-1]
+		}
+		if err != nil || n == 0 {
+			x.done = true
+			x.mu.Unlock()
+			notifyUI()
+			return
+		}
+		x.mu.Unlock()
+		notifyUI()
+	}
+}
+
+// Continue counts the lines added to the file since it was counted
+func (x *lineIndex) Continue() {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	if x.done && x.ctx.Err() == nil {
+		x.done = false
+		go x.run()
+	}
+}
+
+// Close stops counting
+func (x *lineIndex) Close() {
+	x.cancel()
+}
+
+// Lines returns the number of lines counted so far, and whether
+// the whole file has been counted
+func (x *lineIndex) Lines() (int64, bool) {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	lines := x.lines
+	// The last line may not end with a newline
+	if x.done && x.scanned > 0 && x.last != '\n' {
+		lines++
+	}
+	return lines, x.done
+}
+
+// countLines counts the newlines between from and to
+func countLines(f *pagedFile, from int64, to int64) int64 {
+	var lines int64
+	buf := make([]byte, 64*1024)
+	for from < to {
+		chunk := buf
+		if int64(len(chunk)) > to-from {
+			chunk = chunk[:to-from]
+		}
+		n, err := f.ReadAt(chunk, from)
+		lines += int64(bytes.Count(chunk[:n], []byte{'\n'}))
+		from += int64(n)
+		if err != nil || n == 0 {
+			break
+		}
+	}
+	return lines
+}
+
+// LineOf returns the line number (from 0) of the line starting at off,
+// or -1 if the file hasn't been counted that far yet
+func (x *lineIndex) LineOf(off int64) int64 {
+	x.mu.Lock()
+	if off > x.scanned {
+		x.mu.Unlock()
+		return -1
+	}
+	k := sort.Search(len(x.checkpoints), func(i int) bool { return x.checkpoints[i] > off }) - 1
+	cp := x.checkpoints[k]
+	x.mu.Unlock()
+	return int64(k)*linesPerCheckpoint + countLines(x.file, cp, off)
+}
+
+// OffsetOf returns where line n (from 0) starts, or -1 if the file
+// hasn't been counted that far yet. Lines past the end of the file
+// return the size of the file
+func (x *lineIndex) OffsetOf(n int64) int64 {
+	x.mu.Lock()
+	k := n / linesPerCheckpoint
+	if k >= int64(len(x.checkpoints)) {
+		if !x.done {
+			x.mu.Unlock()
+			return -1
+		}
+		k = int64(len(x.checkpoints)) - 1
+	}
+	pos := x.checkpoints[k]
+	x.mu.Unlock()
+	buf := make([]byte, 64*1024)
+	for line := k * linesPerCheckpoint; line < n; {
+		got, err := x.file.ReadAt(buf, pos)
+		data := buf[:got]
+		for line < n {
+			i := bytes.IndexByte(data, '\n')
+			if i < 0 {
+				break
+			}
+			line++
+			pos += int64(i) + 1
+			data = data[i+1:]
+		}
+		if line < n {
+			pos += int64(len(data))
+		}
+		if err != nil || got == 0 {
+			break
+		}
+	}
+	return pos
+}
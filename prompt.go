@@ -0,0 +1,396 @@
+// Copyright 2017 Javier Arevalo <jare@iguanademos.com>
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+// http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Line editing widget and the prompts built on it
+
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"unicode"
+
+	"github.com/mattn/go-runewidth"
+	"github.com/nsf/termbox-go"
+)
+
+// LineEditor is a single line text input. It supports the usual
+// readline keys: arrows, Home/End (Ctrl-A/E), Backspace/Del,
+// Ctrl-W to delete the previous word, Ctrl-U/K to delete to the start
+// or end of the line, and Ctrl-Y to paste the last deleted text
+type LineEditor struct {
+	text   []rune
+	cursor int
+	// First rune shown, when the text doesn't fit
+	scroll int
+	kill   []rune
+}
+
+// NewLineEditor creates an editor with the given text and the
+// cursor at its end
+func NewLineEditor(text string) *LineEditor {
+	e := &LineEditor{}
+	e.SetText(text)
+	return e
+}
+
+// Text returns the current contents of the editor
+func (e *LineEditor) Text() string {
+	return string(e.text)
+}
+
+// SetText replaces the contents and moves the cursor to the end
+func (e *LineEditor) SetText(text string) {
+	e.text = []rune(text)
+	e.cursor = len(e.text)
+	e.scroll = 0
+}
+
+// SetCursor moves the cursor to the given rune position
+func (e *LineEditor) SetCursor(pos int) {
+	if pos < 0 {
+		pos = 0
+	}
+	if pos > len(e.text) {
+		pos = len(e.text)
+	}
+	e.cursor = pos
+}
+
+func (e *LineEditor) insert(r []rune) {
+	text := make([]rune, 0, len(e.text)+len(r))
+	text = append(text, e.text[:e.cursor]...)
+	text = append(text, r...)
+	e.text = append(text, e.text[e.cursor:]...)
+	e.cursor += len(r)
+}
+
+// cut deletes the runes between from and to, saving them for Ctrl-Y
+func (e *LineEditor) cut(from, to int) {
+	if from >= to {
+		return
+	}
+	e.kill = append([]rune(nil), e.text[from:to]...)
+	e.text = append(e.text[:from], e.text[to:]...)
+	e.cursor = from
+}
+
+// wordStart returns the position where the word before the cursor starts
+func (e *LineEditor) wordStart() int {
+	i := e.cursor
+	for i > 0 && unicode.IsSpace(e.text[i-1]) {
+		i--
+	}
+	for i > 0 && !unicode.IsSpace(e.text[i-1]) {
+		i--
+	}
+	return i
+}
+
+// HandleKey processes an editing key, returning false if the key
+// is not one the editor handles
+func (e *LineEditor) HandleKey(ev termbox.Event) bool {
+	switch {
+	case ev.Ch != 0:
+		e.insert([]rune{ev.Ch})
+	case ev.Key == termbox.KeySpace:
+		e.insert([]rune{' '})
+	case ev.Key == termbox.KeyArrowLeft || ev.Key == termbox.KeyCtrlB:
+		e.SetCursor(e.cursor - 1)
+	case ev.Key == termbox.KeyArrowRight || ev.Key == termbox.KeyCtrlF:
+		e.SetCursor(e.cursor + 1)
+	case ev.Key == termbox.KeyHome || ev.Key == termbox.KeyCtrlA:
+		e.cursor = 0
+	case ev.Key == termbox.KeyEnd || ev.Key == termbox.KeyCtrlE:
+		e.cursor = len(e.text)
+	case ev.Key == termbox.KeyBackspace || ev.Key == termbox.KeyBackspace2:
+		if e.cursor > 0 {
+			e.text = append(e.text[:e.cursor-1], e.text[e.cursor:]...)
+			e.cursor--
+		}
+	case ev.Key == termbox.KeyDelete || ev.Key == termbox.KeyCtrlD:
+		if e.cursor < len(e.text) {
+			e.text = append(e.text[:e.cursor], e.text[e.cursor+1:]...)
+		}
+	case ev.Key == termbox.KeyCtrlW:
+		e.cut(e.wordStart(), e.cursor)
+	case ev.Key == termbox.KeyCtrlU:
+		e.cut(0, e.cursor)
+	case ev.Key == termbox.KeyCtrlK:
+		e.cut(e.cursor, len(e.text))
+	case ev.Key == termbox.KeyCtrlY:
+		e.insert(e.kill)
+	default:
+		return false
+	}
+	return true
+}
+
+// Render draws the editor in a line of the given width, scrolling
+// to keep the cursor visible, and places the terminal cursor
+func (e *LineEditor) Render(x, y, w int, fg, bg termbox.Attribute, focused bool) {
+	fill(x, y, w, 1, termbox.Cell{Ch: ' ', Fg: fg, Bg: bg})
+	if w < 2 {
+		return
+	}
+	// Keep one column free for the cursor at the end of the text
+	if e.scroll > e.cursor {
+		e.scroll = e.cursor
+	}
+	for runewidth.StringWidth(string(e.text[e.scroll:e.cursor])) >= w {
+		e.scroll++
+	}
+	cx := x
+	for i := e.scroll; i < len(e.text); i++ {
+		rw := runewidth.RuneWidth(e.text[i])
+		if cx+rw > x+w {
+			break
+		}
+		if i == e.cursor && focused {
+			termbox.SetCursor(cx, y)
+		}
+		if rw > 0 {
+			termbox.SetCell(cx, y, e.text[i], fg, bg)
+		}
+		cx += rw
+	}
+	if e.cursor == len(e.text) && focused {
+		termbox.SetCursor(cx, y)
+	}
+}
+
+// ------------------
+
+// promptView asks for a line of text in a popup
+type promptView struct {
+	Title  string
+	Editor *LineEditor
+	// OnDone receives the text when Enter is pressed. Returning
+	// false keeps the prompt open, eg if the text is not valid
+	OnDone func(text string) bool
+}
+
+func newPromptView(title string, text string, onDone func(text string) bool) *promptView {
+	return &promptView{Title: title, Editor: NewLineEditor(text), OnDone: onDone}
+}
+
+func (v *promptView) Render(w, h int) {
+	bw := w - 4
+	if bw > 80 {
+		bw = 80
+	}
+	x, y := (w-bw)/2, h/2-2
+	drawBox(x, y, bw, 3, v.Title)
+	v.Editor.Render(x+2, y+1, bw-4, termbox.ColorWhite, termbox.ColorBlue, true)
+}
+
+func (v *promptView) HandleKey(ev termbox.Event) bool {
+	switch ev.Key {
+	case termbox.KeyEsc:
+		return false
+	case termbox.KeyEnter:
+		return !v.OnDone(v.Editor.Text())
+	}
+	v.Editor.HandleKey(ev)
+	return true
+}
+
+func (v *promptView) Help() string {
+	return "[ENTER accept] [ESC cancel] [Ctrl-W delete word] [Ctrl-U/K delete to start/end] [Ctrl-Y paste deleted]"
+}
+
+// ------------------
+
+// refreshAfterCreate refreshes both panels after a file was created
+// or renamed in the active panel, leaving the cursor on it
+func refreshAfterCreate(name string) {
+	ap.Refresh()
+	op.Refresh()
+	ap.SetCursor(name)
+}
+
+// startRename asks for a new name for the entry under the cursor
+func startRename() {
+	if !requireFolder(ap) {
+		return
+	}
+	if ap.Cursor >= len(ap.Entries) {
+		return
+	}
+	old := ap.Entries[ap.Cursor].Name()
+	v := newPromptView("Rename "+old+" to", old, func(name string) bool {
+		if name == old {
+			return true
+		}
+		if err := CheckFileName(name); err != nil {
+			status = err.Error()
+			return false
+		}
+		src, dst := filepath.Join(ap.Cwd, old), filepath.Join(ap.Cwd, name)
+		if err := CommandRename(src, dst); err != nil {
+			status = err.Error()
+			return false
+		}
+		journal.Push(&undoEntry{
+			Desc:    fmt.Sprintf("Rename %s to %s", old, name),
+			Records: []undoRecord{newUndoRecord(undoMove, src, dst)},
+		})
+		refreshAfterCreate(name)
+		return true
+	})
+	// Place the cursor before the extension, which is rarely changed
+	if ext := filepath.Ext(old); ext != "" && ext != old && !ap.Entries[ap.Cursor].IsDir() {
+		v.Editor.SetCursor(len([]rune(old)) - len([]rune(ext)))
+	}
+	pushView(v)
+}
+
+// startMkdir asks for the name of a new folder
+func startMkdir() {
+	if !requireFolder(ap) {
+		return
+	}
+	pushView(newPromptView("New folder", "", func(name string) bool {
+		if err := CheckFileName(name); err != nil {
+			status = err.Error()
+			return false
+		}
+		dst := filepath.Join(ap.Cwd, name)
+		if err := CommandMkdir(dst); err != nil {
+			status = err.Error()
+			return false
+		}
+		journal.Push(&undoEntry{
+			Desc:    "Create folder " + name,
+			Records: []undoRecord{newUndoRecord(undoMkdir, "", dst)},
+		})
+		refreshAfterCreate(name)
+		return true
+	}))
+}
+
+// startTouch asks for the name of a new empty file
+func startTouch() {
+	if !requireFolder(ap) {
+		return
+	}
+	pushView(newPromptView("New file", "", func(name string) bool {
+		if err := CheckFileName(name); err != nil {
+			status = err.Error()
+			return false
+		}
+		dst := filepath.Join(ap.Cwd, name)
+		created, err := CommandTouch(dst)
+		if err != nil {
+			status = err.Error()
+			return false
+		}
+		if created {
+			journal.Push(&undoEntry{
+				Desc:    "Create file " + name,
+				Records: []undoRecord{newUndoRecord(undoTouch, "", dst)},
+			})
+		}
+		refreshAfterCreate(name)
+		return true
+	}))
+}
+
+// ------------------
+
+// FormField is an input in a Form: either a line of text or,
+// if Choices is set, one of a list of options
+type FormField struct {
+	Label   string
+	Editor  *LineEditor
+	Choices []string
+	Choice  int
+}
+
+// Text returns the text typed in the field, or the chosen option
+func (f *FormField) Text() string {
+	if f.Choices != nil {
+		return f.Choices[f.Choice]
+	}
+	return f.Editor.Text()
+}
+
+// Form is a list of labeled fields, one of which has the focus.
+// Up/Down and Tab move between fields, Left/Right change options
+type Form struct {
+	Fields []*FormField
+	Focus  int
+}
+
+// AddText adds a text field to the form
+func (f *Form) AddText(label string, text string) *FormField {
+	field := &FormField{Label: label, Editor: NewLineEditor(text)}
+	f.Fields = append(f.Fields, field)
+	return field
+}
+
+// AddChoice adds a field to choose one of the given options
+func (f *Form) AddChoice(label string, choices ...string) *FormField {
+	field := &FormField{Label: label, Choices: choices}
+	f.Fields = append(f.Fields, field)
+	return field
+}
+
+// HandleKey processes a key for the form, returning false if the
+// key is not one the form or its focused field handles
+func (f *Form) HandleKey(ev termbox.Event) bool {
+	field := f.Fields[f.Focus]
+	switch {
+	case ev.Key == termbox.KeyTab || ev.Key == termbox.KeyArrowDown:
+		f.Focus = (f.Focus + 1) % len(f.Fields)
+	case ev.Key == termbox.KeyArrowUp:
+		f.Focus = (f.Focus + len(f.Fields) - 1) % len(f.Fields)
+	case field.Choices != nil && (ev.Key == termbox.KeyArrowRight || ev.Key == termbox.KeySpace):
+		field.Choice = (field.Choice + 1) % len(field.Choices)
+	case field.Choices != nil && ev.Key == termbox.KeyArrowLeft:
+		field.Choice = (field.Choice + len(field.Choices) - 1) % len(field.Choices)
+	case field.Choices != nil:
+		return false
+	default:
+		return field.Editor.HandleKey(ev)
+	}
+	return true
+}
+
+// Render draws the fields one per line, with the labels aligned
+func (f *Form) Render(x, y, w int) {
+	lw := 0
+	for _, field := range f.Fields {
+		if n := runewidth.StringWidth(field.Label); n > lw {
+			lw = n
+		}
+	}
+	for i, field := range f.Fields {
+		focused := i == f.Focus
+		fg := termbox.ColorDefault
+		if focused {
+			fg = termbox.ColorYellow | termbox.AttrBold
+		}
+		tbprintw(x, y+i, lw, fg, termbox.ColorDefault, field.Label)
+		if field.Choices != nil {
+			bg := termbox.ColorDefault
+			if focused {
+				bg = termbox.ColorBlue
+			}
+			tbprintw(x+lw+1, y+i, w-lw-1, termbox.ColorWhite, bg, "< "+field.Text()+" >")
+		} else {
+			field.Editor.Render(x+lw+1, y+i, w-lw-1, termbox.ColorWhite, termbox.ColorBlue, focused)
+		}
+	}
+}
@@ -0,0 +1,381 @@
+// Copyright 2017 Javier Arevalo <jare@iguanademos.com>
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+// http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Quick view: the inactive panel previews the entry at the cursor
+
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/bzip2"
+	"compress/gzip"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"code.cloudfoundry.org/bytefmt"
+	"github.com/nsf/termbox-go"
+)
+
+// The preview is loaded after the cursor stays this long on an entry
+const quickViewDelay = 100 * time.Millisecond
+
+// Only this much of a file is read for the preview
+const quickViewHead = 64 * 1024
+
+// Longer listings of folders and archives are cut
+const maxPreviewLines = 1000
+
+type previewLine struct {
+	Text string
+	Fg   termbox.Attribute
+}
+
+// preview is what the quick view shows of an entry
+type preview struct {
+	Title string
+	Lines []previewLine
+	// Head of a binary file, shown as a hex dump
+	Hex []byte
+	// Shown under the title, like the size of a folder
+	Summary string
+}
+
+// quickViewer loads the previews in the background
+type quickViewer struct {
+	mu     sync.Mutex
+	path   string
+	shown  *preview
+	cancel context.CancelFunc
+}
+
+// quickView is not nil while the quick view is on
+var quickView *quickViewer
+
+func toggleQuickView() {
+	if quickView != nil {
+		quickView.cancelLoad()
+		quickView = nil
+		return
+	}
+	quickView = &quickViewer{}
+	updateQuickView()
+}
+
+// updateQuickView previews the entry at the cursor of the active panel
+func updateQuickView() {
+	if quickView == nil {
+		return
+	}
+	path := ""
+	if ap.Cursor < len(ap.Entries) {
+		path = ap.Path(ap.Entries[ap.Cursor])
+	}
+	quickView.load(path)
+}
+
+func (q *quickViewer) cancelLoad() {
+	if q.cancel != nil {
+		q.cancel()
+		q.cancel = nil
+	}
+}
+
+// load starts loading the preview of path, if it's not the one shown
+// already. Moving the cursor quickly cancels the previews not shown
+func (q *quickViewer) load(path string) {
+	if path == q.path {
+		return
+	}
+	q.path = path
+	q.cancelLoad()
+	if path == "" {
+		q.show(context.Background(), &preview{})
+		return
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	q.cancel = cancel
+	go func() {
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(quickViewDelay):
+		}
+		loadPreview(ctx, path, func(p *preview) {
+			q.show(ctx, p)
+		})
+	}()
+}
+
+// show replaces the preview shown, unless it was cancelled
+func (q *quickViewer) show(ctx context.Context, p *preview) {
+	q.mu.Lock()
+	if ctx.Err() == nil {
+		q.shown = p
+	}
+	q.mu.Unlock()
+	notifyUI()
+}
+
+// loadPreview reads path and calls show with the preview. Folders call
+// show again when their size has been added up
+func loadPreview(ctx context.Context, path string, show func(*preview)) {
+	p := &preview{Title: path}
+	st, err := os.Stat(path)
+	if err != nil {
+		p.Summary = err.Error()
+		show(p)
+		return
+	}
+	if st.IsDir() {
+		previewDir(ctx, path, p, show)
+		return
+	}
+	p.Summary = fmt.Sprintf("%s, modified %s", bytefmt.ByteSize(uint64(st.Size())), st.ModTime().Format("02 Jan 2006 15:04:05"))
+	if !st.Mode().IsRegular() {
+		// Reading devices, pipes and sockets could block or take input
+		p.Summary = fileTypeName(st.Mode()) + ", " + p.Summary
+		show(p)
+		return
+	}
+	if list := archiveLister(path); list != nil {
+		p.Summary += ", archive contents:"
+		if err := list(ctx, path, p); err != nil {
+			p.Lines = append(p.Lines, previewLine{err.Error(), termbox.ColorRed})
+		}
+		show(p)
+		return
+	}
+	previewFile(path, p)
+	show(p)
+}
+
+func previewFile(path string, p *preview) {
+	f, err := os.Open(path)
+	if err != nil {
+		p.Lines = append(p.Lines, previewLine{err.Error(), termbox.ColorRed})
+		return
+	}
+	defer f.Close()
+	head := make([]byte, quickViewHead)
+	n, _ := io.ReadFull(f, head)
+	head = head[:n]
+	if isBinary(head) {
+		p.Hex = head
+		return
+	}
+	for _, line := range bytes.Split(head, []byte{'\n'}) {
+		var b strings.Builder
+		for _, c := range layoutLine(bytes.TrimSuffix(line, []byte{'\r'})) {
+			for k := 0; k < c.width && c.ch == ' '; k++ {
+				b.WriteRune(' ')
+			}
+			if c.ch != ' ' {
+				b.WriteRune(c.ch)
+			}
+		}
+		p.Lines = append(p.Lines, previewLine{b.String(), termbox.ColorDefault})
+	}
+}
+
+// previewDir lists the folder, then adds up the size of its contents
+func previewDir(ctx context.Context, path string, p *preview, show func(*preview)) {
+	infos, err := ioutil.ReadDir(path)
+	if err != nil {
+		p.Summary = err.Error()
+		show(p)
+		return
+	}
+	sort.SliceStable(infos, func(i, j int) bool {
+		return infos[i].IsDir() && !infos[j].IsDir()
+	})
+	for _, e := range infos {
+		if len(p.Lines) == maxPreviewLines {
+			p.Lines = append(p.Lines, previewLine{fmt.Sprintf("... and %d more", len(infos)-maxPreviewLines), termbox.ColorDefault})
+			break
+		}
+		if e.IsDir() {
+			p.Lines = append(p.Lines, previewLine{e.Name() + string(os.PathSeparator), termbox.ColorYellow})
+		} else {
+			p.Lines = append(p.Lines, previewLine{e.Name(), termbox.ColorDefault})
+		}
+	}
+	p.Summary = fmt.Sprintf("%d entries, adding up sizes...", len(infos))
+	show(p)
+
+	var size int64
+	files, dirs := 0, 0
+	filepath.Walk(path, func(name string, info os.FileInfo, err error) error {
+		if ctx.Err() != nil {
+			return ErrCancelled
+		}
+		if err != nil || name == path {
+			return nil
+		}
+		if info.IsDir() {
+			dirs++
+		} else {
+			files++
+			size += info.Size()
+		}
+		return nil
+	})
+	if ctx.Err() != nil {
+		return
+	}
+	done := *p
+	done.Summary = fmt.Sprintf("%s in %d files and %d folders", bytefmt.ByteSize(uint64(size)), files, dirs)
+	show(&done)
+}
+
+// ------------------
+
+type archiveListFunc func(ctx context.Context, path string, p *preview) error
+
+// archiveLister returns how to list the contents of path, or nil if
+// it's not a known archive
+func archiveLister(path string) archiveListFunc {
+	name := strings.ToLower(path)
+	switch {
+	case strings.HasSuffix(name, ".zip") || strings.HasSuffix(name, ".jar"):
+		return listZip
+	case strings.HasSuffix(name, ".tar"):
+		return listTar(nil)
+	case strings.HasSuffix(name, ".tar.gz") || strings.HasSuffix(name, ".tgz"):
+		return listTar(func(r io.Reader) (io.Reader, error) { return gzip.NewReader(r) })
+	case strings.HasSuffix(name, ".tar.bz2") || strings.HasSuffix(name, ".tbz2"):
+		return listTar(func(r io.Reader) (io.Reader, error) { return bzip2.NewReader(r), nil })
+	}
+	return nil
+}
+
+func addArchiveEntry(p *preview, name string, size int64, dir bool) bool {
+	if len(p.Lines) == maxPreviewLines {
+		p.Lines = append(p.Lines, previewLine{"...", termbox.ColorDefault})
+		return false
+	}
+	if dir {
+		p.Lines = append(p.Lines, previewLine{name, termbox.ColorYellow})
+	} else {
+		p.Lines = append(p.Lines, previewLine{fmt.Sprintf("%8s  %s", bytefmt.ByteSize(uint64(size)), name), termbox.ColorDefault})
+	}
+	return true
+}
+
+func listZip(ctx context.Context, path string, p *preview) error {
+	r, err := zip.OpenReader(path)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	for _, f := range r.File {
+		if ctx.Err() != nil || !addArchiveEntry(p, f.Name, int64(f.UncompressedSize64), f.FileInfo().IsDir()) {
+			break
+		}
+	}
+	return nil
+}
+
+func listTar(decompress func(io.Reader) (io.Reader, error)) archiveListFunc {
+	return func(ctx context.Context, path string, p *preview) error {
+		f, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		var r io.Reader = f
+		if decompress != nil {
+			if r, err = decompress(f); err != nil {
+				return err
+			}
+		}
+		tr := tar.NewReader(r)
+		for ctx.Err() == nil {
+			h, err := tr.Next()
+			if err == io.EOF {
+				return nil
+			} else if err != nil {
+				return err
+			}
+			if !addArchiveEntry(p, h.Name, h.Size, h.Typeflag == tar.TypeDir) {
+				return nil
+			}
+		}
+		return nil
+	}
+}
+
+// ------------------
+
+// renderQuickView draws the preview in place of a panel
+func renderQuickView(x, w, h int) {
+	quickView.mu.Lock()
+	p := quickView.shown
+	quickView.mu.Unlock()
+	if p == nil {
+		p = &preview{}
+	}
+	y := 0
+	if p.Summary != "" {
+		tbprintw(x, y, w, termbox.ColorCyan, termbox.ColorDefault, p.Summary)
+		y++
+	}
+	if p.Hex != nil {
+		renderHexHead(x, y, w, h-y, p.Hex)
+	}
+	for _, line := range p.Lines {
+		if y >= h {
+			break
+		}
+		tbprintw(x, y, w, line.Fg, termbox.ColorDefault, line.Text)
+		y++
+	}
+	tbprintw(x, h, w, termbox.ColorWhite, termbox.ColorRed, "Quick view: "+p.Title)
+}
+
+// renderHexHead shows the start of a binary file as a hex dump
+func renderHexHead(x, y, w, h int, data []byte) {
+	n := 16
+	if w < 75 {
+		n = 8
+	}
+	for row := 0; row < h && row*n < len(data); row++ {
+		chunk := data[row*n:]
+		if len(chunk) > n {
+			chunk = chunk[:n]
+		}
+		var hexPart, ascii strings.Builder
+		for i, b := range chunk {
+			fmt.Fprintf(&hexPart, "%02x ", b)
+			if i == n/2-1 {
+				hexPart.WriteByte(' ')
+			}
+			if b < 0x20 || b > 0x7e {
+				b = '.'
+			}
+			ascii.WriteByte(b)
+		}
+		line := fmt.Sprintf("%08x  %-*s %s", row*n, n*3+1, hexPart.String(), ascii.String())
+		tbprintw(x, y+row, w, termbox.ColorDefault, termbox.ColorDefault, line)
+	}
+}
@@ -0,0 +1,663 @@
+// Copyright 2017 Javier Arevalo <jare@iguanademos.com>
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+// http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Renaming many files at once
+
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/nsf/termbox-go"
+)
+
+// renameStep renames the entry From to To, both names inside the same
+// folder. An empty To means moving From to the trash
+type renameStep struct {
+	From string
+	To   string
+}
+
+// renamePlan is a set of renames in a folder, checked and ordered so
+// they can be performed one by one
+type renamePlan struct {
+	Dir string
+	// The changes requested, for the preview
+	Changes []renameStep
+	// Problems found in each change, empty if it is fine
+	Problems []string
+	// The steps to perform, including renames to temporary names
+	// needed to break cycles like a->b, b->a
+	Steps []renameStep
+}
+
+// newRenamePlan checks the changes against each other and the names
+// currently in the folder, and orders them so that no step overwrites
+// an entry that is still to be renamed
+func newRenamePlan(dir string, changes []renameStep, existing []string) *renamePlan {
+	p := &renamePlan{Dir: dir}
+	for _, c := range changes {
+		if c.From != c.To {
+			p.Changes = append(p.Changes, c)
+		}
+	}
+	p.Problems = make([]string, len(p.Changes))
+
+	sources := make(map[string]bool)
+	for _, c := range p.Changes {
+		sources[c.From] = true
+	}
+	targets := make(map[string]int)
+	for _, c := range p.Changes {
+		if c.To != "" {
+			targets[c.To]++
+		}
+	}
+	exists := make(map[string]bool)
+	for _, name := range existing {
+		exists[name] = true
+	}
+	for i, c := range p.Changes {
+		if c.To == "" {
+			continue
+		}
+		if err := CheckFileName(c.To); err != nil {
+			p.Problems[i] = err.Error()
+		} else if targets[c.To] > 1 {
+			p.Problems[i] = fmt.Sprintf("%d files would be renamed to %s", targets[c.To], c.To)
+		} else if exists[c.To] && !sources[c.To] {
+			p.Problems[i] = c.To + " already exists"
+		}
+	}
+	if p.Err() == nil {
+		p.order(exists)
+	}
+	return p
+}
+
+// Err returns an error if any of the changes has problems
+func (p *renamePlan) Err() error {
+	n := 0
+	first := ""
+	for _, problem := range p.Problems {
+		if problem != "" {
+			if n == 0 {
+				first = problem
+			}
+			n++
+		}
+	}
+	if n == 1 {
+		return fmt.Errorf("%s", first)
+	} else if n > 1 {
+		return fmt.Errorf("%s, and %d more problems", first, n-1)
+	}
+	return nil
+}
+
+// order fills in the steps. Deletions go first, then the renames whose
+// target is free. When only cycles remain, one entry in a cycle is moved
+// to a temporary name, which frees its name and breaks the cycle
+func (p *renamePlan) order(exists map[string]bool) {
+	var pending []renameStep
+	for _, c := range p.Changes {
+		if c.To == "" {
+			p.Steps = append(p.Steps, c)
+		} else {
+			pending = append(pending, c)
+		}
+	}
+	temps := 0
+	for len(pending) > 0 {
+		busy := make(map[string]bool)
+		for _, c := range pending {
+			busy[c.From] = true
+		}
+		var next []renameStep
+		for _, c := range pending {
+			if busy[c.To] {
+				next = append(next, c)
+			} else {
+				p.Steps = append(p.Steps, c)
+			}
+		}
+		if len(next) == len(pending) {
+			var temp string
+			for {
+				temps++
+				temp = fmt.Sprintf(".jm-rename-%d-%s", temps, next[0].From)
+				if !exists[temp] {
+					break
+				}
+			}
+			p.Steps = append(p.Steps, renameStep{next[0].From, temp})
+			next[0].From = temp
+		}
+		pending = next
+	}
+}
+
+// apply performs the steps, stopping at the first failure since later
+// steps may depend on it. The steps completed are recorded for undo
+func (p *renamePlan) apply() error {
+	entry := &undoEntry{Desc: fmt.Sprintf("Rename %d files in %s", len(p.Changes), p.Dir)}
+	defer journal.Push(entry)
+	for _, s := range p.Steps {
+		from := filepath.Join(p.Dir, s.From)
+		if s.To == "" {
+			stamp := stampOf(from)
+			item, err := MoveToTrash(from)
+			if err != nil {
+				return err
+			}
+			if TrashRestorable {
+				entry.Records = append(entry.Records, newTrashRecord(item, stamp))
+			}
+			continue
+		}
+		to := filepath.Join(p.Dir, s.To)
+		if err := CommandRename(from, to); err != nil {
+			return err
+		}
+		entry.Records = append(entry.Records, newUndoRecord(undoMove, from, to))
+	}
+	return nil
+}
+
+// applyRenamePlan performs a plan and shows the results
+func applyRenamePlan(p *renamePlan) {
+	if err := p.apply(); err != nil {
+		reportErrors("Rename failed", err)
+		status = "Rename failed, press z to undo the completed renames: " + err.Error()
+	} else {
+		status = fmt.Sprintf("Renamed %d files", len(p.Changes))
+	}
+	ap.Refresh()
+	op.Refresh()
+}
+
+// ------------------
+
+// renamePreviewView shows the changes in a plan before applying them
+type renamePreviewView struct {
+	plan   *renamePlan
+	top    int
+	cursor int
+}
+
+func (v *renamePreviewView) Render(w, h int) {
+	h -= 2
+	drawBox(0, 0, w, h, fmt.Sprintf("Rename %d files in %s", len(v.plan.Changes), v.plan.Dir))
+	renderRenameChanges(0, 1, w, h-1, v.plan, &v.top, v.cursor)
+}
+
+// renderRenameChanges draws the before and after names of the changes
+// in a plan, scrolled to show the cursor. Changes with problems are
+// shown in red, followed by the problem
+func renderRenameChanges(x, y, w, rows int, plan *renamePlan, top *int, cursor int) {
+	if cursor < *top {
+		*top = cursor
+	} else if cursor >= *top+rows {
+		*top = cursor - rows + 1
+	}
+	if *top < 0 {
+		*top = 0
+	}
+	col := w/2 - 2
+	for i := 0; i < rows && *top+i < len(plan.Changes); i++ {
+		n := *top + i
+		c := plan.Changes[n]
+		fg, bg := termbox.ColorDefault, termbox.ColorDefault
+		if plan.Problems[n] != "" {
+			fg = termbox.ColorRed
+		}
+		if n == cursor {
+			fg, bg = termbox.ColorBlack, termbox.ColorGreen
+			if plan.Problems[n] != "" {
+				bg = termbox.ColorRed
+			}
+		}
+		to := c.To
+		if to == "" {
+			to = "(to the trash)"
+		}
+		if plan.Problems[n] != "" {
+			to = to + "  <- " + plan.Problems[n]
+		}
+		fill(x, y+i, w, 1, termbox.Cell{Ch: ' ', Bg: bg})
+		tbprintw(x+1, y+i, col-1, fg, bg, c.From)
+		tbprint(x+col, y+i, fg, bg, "->")
+		tbprintw(x+col+3, y+i, w-col-4, fg, bg, to)
+	}
+	if len(plan.Changes) == 0 {
+		tbprint(x+1, y, termbox.ColorDefault, termbox.ColorDefault, "No names changed")
+	}
+}
+
+func (v *renamePreviewView) HandleKey(ev termbox.Event) bool {
+	if ev.Key == termbox.KeyEsc || ev.Ch == 'q' || ev.Ch == 'n' {
+		status = "Rename cancelled"
+		return false
+	} else if ev.Key == termbox.KeyEnter || ev.Ch == 'y' {
+		if err := v.plan.Err(); err != nil {
+			status = err.Error()
+			return true
+		}
+		applyRenamePlan(v.plan)
+		return false
+	} else if ev.Key == termbox.KeyArrowUp || ev.Ch == 'k' {
+		v.cursor--
+	} else if ev.Key == termbox.KeyArrowDown || ev.Ch == 'j' {
+		v.cursor++
+	} else if ev.Key == termbox.KeyPgup || ev.Ch == 'u' {
+		v.cursor -= 20
+	} else if ev.Key == termbox.KeyPgdn || ev.Ch == 'i' {
+		v.cursor += 20
+	} else if ev.Key == termbox.KeyHome || ev.Ch == 'U' {
+		v.cursor = 0
+	} else if ev.Key == termbox.KeyEnd || ev.Ch == 'I' {
+		v.cursor = len(v.plan.Changes) - 1
+	}
+	if v.cursor >= len(v.plan.Changes) {
+		v.cursor = len(v.plan.Changes) - 1
+	}
+	if v.cursor < 0 {
+		v.cursor = 0
+	}
+	return true
+}
+
+func (v *renamePreviewView) Help() string {
+	if v.plan.Err() != nil {
+		return "[ESC,q,n cancel] [ARROWS nav] Fix the problems in red to rename"
+	}
+	return "[ENTER,y rename] [ESC,q,n cancel] [ARROWS nav]"
+}
+
+// ------------------
+
+// panelNames returns the names of all the entries in a panel,
+// including those hidden by the filter
+func panelNames(p *Panel) []string {
+	names := make([]string, len(p.All))
+	for i, e := range p.All {
+		names[i] = e.Name()
+	}
+	return names
+}
+
+// startBulkRename writes the names of the selected files to a temporary
+// file, one per line and numbered, and opens it in the user's editor.
+// The edited names are then shown in a preview, to be confirmed
+func startBulkRename() {
+	if !requireFolder(ap) {
+		return
+	}
+	src, _ := getCommandArguments()
+	if len(src) == 0 {
+		return
+	}
+	f, err := ioutil.TempFile("", "jm-rename-*.txt")
+	if err != nil {
+		status = err.Error()
+		return
+	}
+	defer os.Remove(f.Name())
+	names := make([]string, len(src))
+	for i, s := range src {
+		names[i] = filepath.Base(s)
+		if strings.ContainsAny(names[i], "\r\n") {
+			f.Close()
+			status = fmt.Sprintf("Can't edit the name %q, it has line breaks", names[i])
+			return
+		}
+		fmt.Fprintf(f, "%d\t%s\n", i+1, names[i])
+	}
+	if err = f.Close(); err != nil {
+		status = err.Error()
+		return
+	}
+
+	if err = runSuspended(func() error { return RunEditor(f.Name()) }); err != nil {
+		status = err.Error()
+		return
+	}
+	edited, err := readBulkRename(f.Name(), names)
+	if err != nil {
+		status = err.Error()
+		return
+	}
+	changes := bulkRenameChanges(names, edited, bulkRenameDeletes)
+	plan := newRenamePlan(ap.Cwd, changes, panelNames(ap))
+	if len(plan.Changes) == 0 {
+		status = "No names changed"
+		return
+	}
+	pushView(&renamePreviewView{plan: plan})
+}
+
+// readBulkRename parses the file edited by the user, returning the new
+// name for each of the original names by index. Lines that were
+// removed have no entry
+func readBulkRename(file string, names []string) (map[int]string, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	edited := make(map[int]string)
+	scanner := bufio.NewScanner(f)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimRight(scanner.Text(), "\r")
+		if strings.TrimSpace(text) == "" {
+			continue
+		}
+		fields := strings.SplitN(text, "\t", 2)
+		n, err := strconv.Atoi(strings.TrimSpace(fields[0]))
+		if err != nil || len(fields) < 2 || n < 1 || n > len(names) {
+			return nil, fmt.Errorf("Line %d of the edited names must start with the number of the file and a tab", line)
+		}
+		if _, ok := edited[n-1]; ok {
+			return nil, fmt.Errorf("File number %d appears more than once", n)
+		}
+		edited[n-1] = fields[1]
+	}
+	return edited, scanner.Err()
+}
+
+// bulkRenameChanges turns the edited names into changes. Files whose
+// line was removed are moved to the trash if deletes is set, and left
+// alone otherwise
+func bulkRenameChanges(names []string, edited map[int]string, deletes bool) []renameStep {
+	var changes []renameStep
+	for i, name := range names {
+		if to, ok := edited[i]; ok {
+			changes = append(changes, renameStep{name, to})
+		} else if deletes {
+			changes = append(changes, renameStep{name, ""})
+		}
+	}
+	return changes
+}
+
+// ------------------
+
+// templatePart is a piece of a rename template: either literal text,
+// which may refer to the groups captured by the find pattern as $1,
+// or a {token} like {n:03}
+type templatePart struct {
+	Text  string
+	Token string
+	Arg   string
+}
+
+// renamePattern builds new names by replacing the matches of a regular
+// expression with a template, and optionally changing the case
+type renamePattern struct {
+	find  *regexp.Regexp
+	parts []templatePart
+	cased string
+}
+
+// The case changes for renamePattern
+const (
+	caseKeep  = "Keep"
+	caseLower = "lower"
+	caseUpper = "UPPER"
+	caseTitle = "Title"
+)
+
+var renameCases = []string{caseKeep, caseLower, caseUpper, caseTitle}
+
+// dateLayout turns the date formats in templates, like YYYY-MM-DD,
+// into Go layouts
+var dateLayout = strings.NewReplacer("YYYY", "2006", "YY", "06", "MM", "01", "DD", "02", "hh", "15", "mm", "04", "ss", "05")
+
+// newRenamePattern parses the pattern. An empty find pattern
+// matches the whole name
+func newRenamePattern(find string, replace string, cased string) (*renamePattern, error) {
+	if find == "" {
+		find = "^.*$"
+	}
+	re, err := regexp.Compile(find)
+	if err != nil {
+		return nil, fmt.Errorf("Bad find pattern: %s", err)
+	}
+	p := &renamePattern{find: re, cased: cased}
+	for replace != "" {
+		i := strings.IndexAny(replace, "{}")
+		if i < 0 {
+			p.parts = append(p.parts, templatePart{Text: replace})
+			break
+		}
+		// Doubled braces are literal
+		if i+1 < len(replace) && replace[i+1] == replace[i] {
+			p.parts = append(p.parts, templatePart{Text: replace[:i+1]})
+			replace = replace[i+2:]
+			continue
+		}
+		if replace[i] == '}' {
+			return nil, fmt.Errorf("Unexpected } in the replacement, use }} for a literal one")
+		}
+		// A ${1} reference to a group is left for the regexp
+		if i > 0 && replace[i-1] == '$' {
+			end := strings.IndexByte(replace[i:], '}')
+			if end < 0 {
+				return nil, fmt.Errorf("Missing } in the replacement")
+			}
+			p.parts = append(p.parts, templatePart{Text: replace[:i+end+1]})
+			replace = replace[i+end+1:]
+			continue
+		}
+		end := strings.IndexByte(replace[i:], '}')
+		if end < 0 {
+			return nil, fmt.Errorf("Missing } in the replacement, use {{ for a literal {")
+		}
+		if i > 0 {
+			p.parts = append(p.parts, templatePart{Text: replace[:i]})
+		}
+		token := replace[i+1 : i+end]
+		part := templatePart{Token: token}
+		if colon := strings.IndexByte(token, ':'); colon >= 0 {
+			part.Token, part.Arg = token[:colon], token[colon+1:]
+		}
+		switch part.Token {
+		case "n", "date", "time", "name", "ext":
+		default:
+			return nil, fmt.Errorf("Unknown token {%s} in the replacement", token)
+		}
+		if part.Token == "n" && part.Arg != "" {
+			if _, err := strconv.Atoi(part.Arg); err != nil {
+				return nil, fmt.Errorf("The counter width in {%s} must be a number", token)
+			}
+		}
+		p.parts = append(p.parts, part)
+		replace = replace[i+end+1:]
+	}
+	return p, nil
+}
+
+// expandToken returns the value of a template token for a file,
+// n being the position of the file in the list being renamed
+func expandToken(part templatePart, info os.FileInfo, n int) string {
+	name := info.Name()
+	ext := filepath.Ext(name)
+	if ext == name {
+		ext = ""
+	}
+	switch part.Token {
+	case "n":
+		if part.Arg == "" {
+			return strconv.Itoa(n)
+		}
+		width, _ := strconv.Atoi(part.Arg)
+		if strings.HasPrefix(part.Arg, "0") {
+			return fmt.Sprintf("%0*d", width, n)
+		}
+		return fmt.Sprintf("%*d", width, n)
+	case "date", "time":
+		format := part.Arg
+		if format == "" && part.Token == "date" {
+			format = "YYYY-MM-DD"
+		} else if format == "" {
+			format = "hh-mm-ss"
+		}
+		return info.ModTime().Format(dateLayout.Replace(format))
+	case "name":
+		return strings.TrimSuffix(name, ext)
+	case "ext":
+		return ext
+	}
+	return ""
+}
+
+// Apply returns the new name for a file
+func (p *renamePattern) Apply(info os.FileInfo, n int) string {
+	name := info.Name()
+	var b []byte
+	last := 0
+	for _, m := range p.find.FindAllStringSubmatchIndex(name, -1) {
+		b = append(b, name[last:m[0]]...)
+		for _, part := range p.parts {
+			if part.Token == "" {
+				b = p.find.ExpandString(b, part.Text, name, m)
+			} else {
+				b = append(b, expandToken(part, info, n)...)
+			}
+		}
+		last = m[1]
+	}
+	b = append(b, name[last:]...)
+	result := string(b)
+	switch p.cased {
+	case caseLower:
+		result = strings.ToLower(result)
+	case caseUpper:
+		result = strings.ToUpper(result)
+	case caseTitle:
+		result = strings.Title(strings.ToLower(result))
+	}
+	return result
+}
+
+// patternRenameView is a dialog to rename the selected files with
+// a find and replace pattern, showing the results as they are typed
+type patternRenameView struct {
+	form    Form
+	find    *FormField
+	replace *FormField
+	cased   *FormField
+	entries []os.FileInfo
+	plan    *renamePlan
+	err     error
+	top     int
+	cursor  int
+}
+
+// startPatternRename opens the pattern rename dialog for the selected files
+func startPatternRename() {
+	if requireFolder(ap) {
+		pushView(newPatternRenameView())
+	}
+}
+
+func newPatternRenameView() *patternRenameView {
+	v := &patternRenameView{entries: selectedEntries()}
+	v.find = v.form.AddText("Find (regexp)", "")
+	v.replace = v.form.AddText("Replace with", "")
+	v.cased = v.form.AddChoice("Change case", renameCases...)
+	v.update()
+	return v
+}
+
+// update recomputes the new names
+func (v *patternRenameView) update() {
+	v.plan = nil
+	pattern, err := newRenamePattern(v.find.Text(), v.replace.Text(), v.cased.Text())
+	v.err = err
+	if err != nil {
+		return
+	}
+	// The template is not applied until something is typed, so
+	// an empty replacement doesn't blank every name
+	if v.find.Text() == "" && v.replace.Text() == "" {
+		pattern, _ = newRenamePattern("", "$0", v.cased.Text())
+	}
+	changes := make([]renameStep, len(v.entries))
+	for i, e := range v.entries {
+		changes[i] = renameStep{e.Name(), pattern.Apply(e, i+1)}
+	}
+	v.plan = newRenamePlan(ap.Cwd, changes, panelNames(ap))
+}
+
+func (v *patternRenameView) Render(w, h int) {
+	h -= 2
+	drawBox(0, 0, w, h, fmt.Sprintf("Rename %d files in %s", len(v.entries), ap.Cwd))
+	v.form.Render(1, 1, w-2)
+	tbprintw(1, 5, w-2, termbox.ColorCyan, termbox.ColorDefault,
+		"Replace with ${1} groups, {n} {n:03} counter, {date} {date:YYYYMMDD} {time} {time:hhmmss} modified, {name} {ext}")
+	if v.err != nil {
+		tbprintw(1, 7, w-2, termbox.ColorRed, termbox.ColorDefault, v.err.Error())
+		return
+	}
+	tbprintw(1, 7, w-2, termbox.ColorDefault, termbox.ColorDefault, fmt.Sprintf("%d of %d names change:", len(v.plan.Changes), len(v.entries)))
+	if v.cursor >= len(v.plan.Changes) {
+		v.cursor = len(v.plan.Changes) - 1
+	}
+	if v.cursor < 0 {
+		v.cursor = 0
+	}
+	renderRenameChanges(0, 8, w, h-8, v.plan, &v.top, v.cursor)
+}
+
+func (v *patternRenameView) HandleKey(ev termbox.Event) bool {
+	switch ev.Key {
+	case termbox.KeyEsc:
+		return false
+	case termbox.KeyEnter:
+		if v.err != nil {
+			status = v.err.Error()
+			return true
+		}
+		if err := v.plan.Err(); err != nil {
+			status = err.Error()
+			return true
+		}
+		if len(v.plan.Changes) > 0 {
+			applyRenamePlan(v.plan)
+		}
+		return false
+	case termbox.KeyPgup:
+		v.cursor -= 10
+		return true
+	case termbox.KeyPgdn:
+		v.cursor += 10
+		return true
+	}
+	if v.form.HandleKey(ev) {
+		v.update()
+	}
+	return true
+}
+
+func (v *patternRenameView) Help() string {
+	return "[ENTER rename] [ESC cancel] [TAB,UP/DOWN fields] [LEFT/RIGHT case] [PGUP/PGDN scroll preview]"
+}
@@ -0,0 +1,351 @@
+// Copyright 2017 Javier Arevalo <jare@iguanademos.com>
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+// http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// runSteps performs the steps of a plan on a folder simulated with a
+// map from names to contents, failing if a step overwrites an entry
+func runSteps(t *testing.T, files map[string]string, steps []renameStep) {
+	t.Helper()
+	for _, s := range steps {
+		content, ok := files[s.From]
+		if !ok {
+			t.Fatalf("step %v: %s doesn't exist", s, s.From)
+		}
+		delete(files, s.From)
+		if s.To == "" {
+			continue
+		}
+		if _, ok := files[s.To]; ok {
+			t.Fatalf("step %v overwrites %s", s, s.To)
+		}
+		files[s.To] = content
+	}
+}
+
+func TestRenamePlan(t *testing.T) {
+	tests := []struct {
+		name     string
+		existing []string
+		changes  []renameStep
+		// Contents by name after the renames, each file starting
+		// with its own name as content. Nil if the plan has problems
+		want map[string]string
+	}{
+		{
+			name:     "simple",
+			existing: []string{"a", "b"},
+			changes:  []renameStep{{"a", "c"}},
+			want:     map[string]string{"c": "a", "b": "b"},
+		},
+		{
+			name:     "unchanged names are dropped",
+			existing: []string{"a", "b"},
+			changes:  []renameStep{{"a", "a"}, {"b", "c"}},
+			want:     map[string]string{"a": "a", "c": "b"},
+		},
+		{
+			name:     "swap",
+			existing: []string{"a", "b"},
+			changes:  []renameStep{{"a", "b"}, {"b", "a"}},
+			want:     map[string]string{"a": "b", "b": "a"},
+		},
+		{
+			name:     "cycle of three",
+			existing: []string{"a", "b", "c"},
+			changes:  []renameStep{{"a", "b"}, {"b", "c"}, {"c", "a"}},
+			want:     map[string]string{"a": "c", "b": "a", "c": "b"},
+		},
+		{
+			name:     "chain",
+			existing: []string{"a", "b"},
+			changes:  []renameStep{{"a", "b"}, {"b", "c"}},
+			want:     map[string]string{"b": "a", "c": "b"},
+		},
+		{
+			name:     "delete frees the name",
+			existing: []string{"a", "b"},
+			changes:  []renameStep{{"a", ""}, {"b", "a"}},
+			want:     map[string]string{"a": "b"},
+		},
+		{
+			name:     "temporary name taken",
+			existing: []string{"a", "b", ".jm-rename-1-a"},
+			changes:  []renameStep{{"a", "b"}, {"b", "a"}},
+			want:     map[string]string{"a": "b", "b": "a", ".jm-rename-1-a": ".jm-rename-1-a"},
+		},
+		{
+			name:     "target is an untouched file",
+			existing: []string{"a", "b", "c"},
+			changes:  []renameStep{{"a", "c"}},
+		},
+		{
+			name:     "two files to the same name",
+			existing: []string{"a", "b"},
+			changes:  []renameStep{{"a", "c"}, {"b", "c"}},
+		},
+		{
+			name:     "path separator",
+			existing: []string{"a"},
+			changes:  []renameStep{{"a", "x/y"}},
+		},
+		{
+			name:     "empty name",
+			existing: []string{"a"},
+			changes:  []renameStep{{"a", " "}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := newRenamePlan("dir", tt.changes, tt.existing)
+			if tt.want == nil {
+				if p.Err() == nil {
+					t.Fatalf("expected problems, got steps %v", p.Steps)
+				}
+				if len(p.Steps) != 0 {
+					t.Errorf("a plan with problems has steps %v", p.Steps)
+				}
+				return
+			}
+			if err := p.Err(); err != nil {
+				t.Fatalf("unexpected problem: %s", err)
+			}
+			files := make(map[string]string)
+			for _, name := range tt.existing {
+				files[name] = name
+			}
+			runSteps(t, files, p.Steps)
+			if !reflect.DeepEqual(files, tt.want) {
+				t.Errorf("got %v, want %v", files, tt.want)
+			}
+		})
+	}
+}
+
+func TestRenamePlanApply(t *testing.T) {
+	dir, err := ioutil.TempDir("", "jm-rename-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	for _, name := range []string{"a", "b", "c", "d"} {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(name), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	changes := []renameStep{{"a", "b"}, {"b", "c"}, {"c", "a"}, {"d", "e"}}
+	p := newRenamePlan(dir, changes, []string{"a", "b", "c", "d"})
+	if err := p.apply(); err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]string{"a": "c", "b": "a", "c": "b", "e": "d"}
+	infos, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := make(map[string]string)
+	for _, info := range infos {
+		data, err := ioutil.ReadFile(filepath.Join(dir, info.Name()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		got[info.Name()] = string(data)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
+
+func TestReadBulkRename(t *testing.T) {
+	names := []string{"one", "two", "three"}
+	tests := []struct {
+		name string
+		text string
+		want map[int]string
+		err  bool
+	}{
+		{
+			name: "all lines",
+			text: "1\tuno\n2\ttwo\n3\ttres\n",
+			want: map[int]string{0: "uno", 1: "two", 2: "tres"},
+		},
+		{
+			name: "reordered, CRLF and blank lines",
+			text: "3\ttres\r\n\r\n1\tuno\r\n2\ttwo\r\n",
+			want: map[int]string{0: "uno", 1: "two", 2: "tres"},
+		},
+		{
+			name: "line removed",
+			text: "1\tuno\n3\tthree\n",
+			want: map[int]string{0: "uno", 2: "three"},
+		},
+		{
+			name: "all lines removed",
+			text: "",
+			want: map[int]string{},
+		},
+		{
+			name: "names keep their spaces and tabs",
+			text: "1\t uno\tdos \n",
+			want: map[int]string{0: " uno\tdos "},
+		},
+		{
+			name: "line added",
+			text: "1\tuno\n2\ttwo\n3\ttres\n4\tcuatro\n",
+			err:  true,
+		},
+		{
+			name: "line without a number",
+			text: "1\tuno\nfour\n",
+			err:  true,
+		},
+		{
+			name: "number without a tab",
+			text: "1 uno\n",
+			err:  true,
+		},
+		{
+			name: "number repeated",
+			text: "1\tuno\n1\tone\n",
+			err:  true,
+		},
+		{
+			name: "number zero",
+			text: "0\tcero\n",
+			err:  true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f, err := ioutil.TempFile("", "jm-rename-test-*.txt")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.Remove(f.Name())
+			f.WriteString(tt.text)
+			f.Close()
+			got, err := readBulkRename(f.Name(), names)
+			if tt.err {
+				if err == nil {
+					t.Fatalf("expected an error, got %v", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestBulkRenameChanges(t *testing.T) {
+	names := []string{"one", "two", "three"}
+	edited := map[int]string{0: "uno", 2: "three"}
+	tests := []struct {
+		deletes bool
+		want    []renameStep
+	}{
+		{false, []renameStep{{"one", "uno"}, {"three", "three"}}},
+		{true, []renameStep{{"one", "uno"}, {"two", ""}, {"three", "three"}}},
+	}
+	for _, tt := range tests {
+		got := bulkRenameChanges(names, edited, tt.deletes)
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("deletes %v: got %v, want %v", tt.deletes, got, tt.want)
+		}
+	}
+}
+
+// fakeInfo is the information of a file that doesn't exist
+type fakeInfo struct {
+	name    string
+	modTime time.Time
+}
+
+func (f fakeInfo) Name() string       { return f.name }
+func (f fakeInfo) Size() int64        { return 0 }
+func (f fakeInfo) Mode() os.FileMode  { return 0644 }
+func (f fakeInfo) ModTime() time.Time { return f.modTime }
+func (f fakeInfo) IsDir() bool        { return false }
+func (f fakeInfo) Sys() interface{}   { return nil }
+
+func TestRenamePattern(t *testing.T) {
+	modTime := time.Date(2017, 6, 30, 14, 5, 9, 0, time.Local)
+	tests := []struct {
+		find, replace, cased string
+		name                 string
+		n                    int
+		want                 string
+	}{
+		{"", "{n:03}{ext}", caseKeep, "photo.JPG", 7, "007.JPG"},
+		{"", "{n}-{name}", caseKeep, "photo.jpg", 12, "12-photo"},
+		{"", "{n:3}", caseKeep, "photo.jpg", 7, "  7"},
+		{"", "{name}_{date}{ext}", caseKeep, "report.txt", 1, "report_2017-06-30.txt"},
+		{"", "{date:YYYYMMDD}-{time}", caseKeep, "a", 1, "20170630-14-05-09"},
+		{"", "{time:hh.mm}", caseKeep, "a", 1, "14.05"},
+		{"", "{name}+{ext}", caseKeep, ".bashrc", 1, ".bashrc+"},
+		{`(\w+)-(\w+)`, "$2-$1", caseKeep, "left-right.txt", 1, "right-left.txt"},
+		{`^(\w+)`, "${1}x", caseKeep, "abc.txt", 1, "abcx.txt"},
+		{"a", "o", caseKeep, "banana", 1, "bonono"},
+		{"an", "{n}", caseKeep, "banana", 4, "b44a"},
+		{`\.jpeg$`, ".jpg", caseKeep, "a.jpeg.jpeg", 1, "a.jpeg.jpg"},
+		{"x", "y", caseKeep, "abc", 1, "abc"},
+		{"", "{{{n}}}", caseKeep, "a", 5, "{5}"},
+		{"", "$0", caseLower, "Hello World.TXT", 1, "hello world.txt"},
+		{"", "$0", caseUpper, "Hello World.txt", 1, "HELLO WORLD.TXT"},
+		{"", "$0", caseTitle, "hELLO wORLD", 1, "Hello World"},
+		{" ", "_", caseLower, "My Photo.JPG", 1, "my_photo.jpg"},
+	}
+	for _, tt := range tests {
+		p, err := newRenamePattern(tt.find, tt.replace, tt.cased)
+		if err != nil {
+			t.Errorf("%q %q: unexpected error: %s", tt.find, tt.replace, err)
+			continue
+		}
+		got := p.Apply(fakeInfo{tt.name, modTime}, tt.n)
+		if got != tt.want {
+			t.Errorf("%q %q %s on %q: got %q, want %q", tt.find, tt.replace, tt.cased, tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestRenamePatternErrors(t *testing.T) {
+	tests := []struct {
+		find, replace string
+	}{
+		{"(", "x"},
+		{"", "{foo}"},
+		{"", "{n:x}"},
+		{"", "{n"},
+		{"", "n}"},
+		{"(a)", "${1"},
+	}
+	for _, tt := range tests {
+		if _, err := newRenamePattern(tt.find, tt.replace, caseKeep); err == nil {
+			t.Errorf("%q %q: expected an error", tt.find, tt.replace)
+		}
+	}
+}
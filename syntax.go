@@ -0,0 +1,551 @@
+// Copyright 2017 Javier Arevalo <jare@iguanademos.com>
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+// http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Syntax highlighting for the viewer
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/nsf/termbox-go"
+)
+
+// syntaxClass is the kind of text a byte of a line belongs to
+type syntaxClass byte
+
+const (
+	synNone syntaxClass = iota
+	synKeyword
+	synType
+	synString
+	synComment
+	synNumber
+	synPreproc
+	synVariable
+	synKey
+	synHeading
+	synAdded
+	synRemoved
+	synMeta
+	numSyntaxClasses
+)
+
+// Names of the classes in the SyntaxColors setting of the config file
+var syntaxClassNames = [numSyntaxClasses]string{
+	"", "keyword", "type", "string", "comment", "number", "preproc",
+	"variable", "key", "heading", "added", "removed", "meta",
+}
+
+var defaultSyntaxColors = map[string]string{
+	"keyword":  "bold yellow",
+	"type":     "green",
+	"string":   "magenta",
+	"comment":  "cyan",
+	"number":   "red",
+	"preproc":  "blue",
+	"variable": "green",
+	"key":      "bold blue",
+	"heading":  "bold white",
+	"added":    "green",
+	"removed":  "red",
+	"meta":     "bold cyan",
+}
+
+// syntaxColorConfig is the setting from the config file,
+// syntaxColors are the colors used
+var syntaxColorConfig map[string]string
+var syntaxColors [numSyntaxClasses]termbox.Attribute
+
+var colorNames = map[string]termbox.Attribute{
+	"default": termbox.ColorDefault,
+	"black":   termbox.ColorBlack,
+	"red":     termbox.ColorRed,
+	"green":   termbox.ColorGreen,
+	"yellow":  termbox.ColorYellow,
+	"blue":    termbox.ColorBlue,
+	"magenta": termbox.ColorMagenta,
+	"cyan":    termbox.ColorCyan,
+	"white":   termbox.ColorWhite,
+}
+
+var attrNames = map[string]termbox.Attribute{
+	"bold":      termbox.AttrBold,
+	"underline": termbox.AttrUnderline,
+	"reverse":   termbox.AttrReverse,
+}
+
+// parseColor reads a color like "yellow" or "bold cyan"
+func parseColor(s string) (termbox.Attribute, error) {
+	color := termbox.ColorDefault
+	for _, word := range strings.Fields(strings.ToLower(s)) {
+		if c, ok := colorNames[word]; ok {
+			color = color&^0xff | c
+		} else if a, ok := attrNames[word]; ok {
+			color |= a
+		} else {
+			return 0, fmt.Errorf("unknown color %q", word)
+		}
+	}
+	return color, nil
+}
+
+// setSyntaxColors sets the colors of the classes from the config file,
+// using the default colors for those missing or wrong
+func setSyntaxColors(config map[string]string) error {
+	syntaxColorConfig = make(map[string]string)
+	for name, color := range defaultSyntaxColors {
+		syntaxColorConfig[name] = color
+	}
+	var bad []string
+	for name, color := range config {
+		name = strings.ToLower(name)
+		if _, ok := defaultSyntaxColors[name]; !ok {
+			bad = append(bad, name)
+			continue
+		}
+		if _, err := parseColor(color); err != nil {
+			bad = append(bad, name)
+			continue
+		}
+		syntaxColorConfig[name] = color
+	}
+	for i, name := range syntaxClassNames {
+		if name != "" {
+			syntaxColors[i], _ = parseColor(syntaxColorConfig[name])
+		}
+	}
+	if len(bad) > 0 {
+		sort.Strings(bad)
+		return fmt.Errorf("Wrong SyntaxColors in the config file: %s", strings.Join(bad, ", "))
+	}
+	return nil
+}
+
+// ------------------
+
+// States of a highlighter between lines
+const (
+	synStateNormal = iota
+	synStateBlockComment
+	synStateRawString
+	// Python strings in """ or '''
+	synStateTriple2
+	synStateTriple1
+	// Markdown fenced code blocks
+	synStateFence
+)
+
+// syntax describes how to highlight a language
+type syntax struct {
+	name string
+	// highlight finds the class of each byte of a line, given the state
+	// at its start, and returns the state at its end
+	highlight   func(s *syntax, line []byte, state int) ([]syntaxClass, int)
+	keywords    map[string]bool
+	types       map[string]bool
+	lineComment string
+	blockStart  string
+	blockEnd    string
+	quotes      string
+	rawQuote    byte
+	triple      bool
+	preproc     bool
+	// $NAME and ${NAME} are variables
+	variables bool
+	// Strings followed by : are keys
+	keys bool
+}
+
+func words(s string) map[string]bool {
+	m := make(map[string]bool)
+	for _, w := range strings.Fields(s) {
+		m[w] = true
+	}
+	return m
+}
+
+var syntaxGo = &syntax{
+	name:      "Go",
+	highlight: highlightCode,
+	keywords: words(`break case chan const continue default defer else fallthrough for func go goto
+		if import interface map package range return select struct switch type var
+		true false nil iota`),
+	types: words(`bool byte complex64 complex128 error float32 float64 int int8 int16 int32 int64
+		rune string uint uint8 uint16 uint32 uint64 uintptr any
+		append cap close complex copy delete imag len make new panic print println real recover`),
+	lineComment: "//", blockStart: "/*", blockEnd: "*/",
+	quotes: `"'`, rawQuote: '`',
+}
+
+var syntaxC = &syntax{
+	name:      "C",
+	highlight: highlightCode,
+	keywords: words(`auto break case const continue default do else enum extern for goto if inline
+		register restrict return sizeof static struct switch typedef union volatile while
+		class namespace template typename public private protected virtual override new delete
+		this using try catch throw operator friend constexpr nullptr true false NULL`),
+	types: words(`void char short int long float double signed unsigned bool size_t ssize_t
+		int8_t int16_t int32_t int64_t uint8_t uint16_t uint32_t uint64_t FILE`),
+	lineComment: "//", blockStart: "/*", blockEnd: "*/",
+	quotes: `"'`, preproc: true,
+}
+
+var syntaxPython = &syntax{
+	name:      "Python",
+	highlight: highlightCode,
+	keywords: words(`and as assert async await break class continue def del elif else except finally
+		for from global if import in is lambda nonlocal not or pass raise return try while
+		with yield True False None self`),
+	types: words(`int float str bytes bool list dict set tuple object type len range print
+		open isinstance super Exception`),
+	lineComment: "#", quotes: `"'`, triple: true,
+}
+
+var syntaxShell = &syntax{
+	name:      "shell",
+	highlight: highlightCode,
+	keywords: words(`if then else elif fi case esac for while until do done in function
+		select time return break continue exit export local readonly declare set unset
+		shift source alias eval exec trap`),
+	lineComment: "#", quotes: `"'`, rawQuote: '`', variables: true,
+}
+
+var syntaxJSON = &syntax{
+	name:      "JSON",
+	highlight: highlightCode,
+	keywords:  words(`true false null`),
+	quotes:    `"`, keys: true,
+}
+
+var syntaxYAML = &syntax{
+	name:        "YAML",
+	highlight:   highlightYAML,
+	keywords:    words(`true false null yes no on off True False Null Yes No On Off ~`),
+	lineComment: "#", quotes: `"'`,
+}
+
+var syntaxMarkdown = &syntax{
+	name:      "Markdown",
+	highlight: highlightMarkdown,
+}
+
+var syntaxDiff = &syntax{
+	name:      "diff",
+	highlight: highlightDiff,
+}
+
+var syntaxByExtension = map[string]*syntax{
+	".go":       syntaxGo,
+	".c":        syntaxC,
+	".h":        syntaxC,
+	".cc":       syntaxC,
+	".cpp":      syntaxC,
+	".cxx":      syntaxC,
+	".hpp":      syntaxC,
+	".py":       syntaxPython,
+	".sh":       syntaxShell,
+	".bash":     syntaxShell,
+	".zsh":      syntaxShell,
+	".ksh":      syntaxShell,
+	".json":     syntaxJSON,
+	".yaml":     syntaxYAML,
+	".yml":      syntaxYAML,
+	".md":       syntaxMarkdown,
+	".markdown": syntaxMarkdown,
+	".diff":     syntaxDiff,
+	".patch":    syntaxDiff,
+}
+
+// detectSyntax chooses the syntax of a file by its extension, or by
+// the interpreter in its first line if it starts with #!
+func detectSyntax(path string, first []byte) *syntax {
+	if s := syntaxByExtension[strings.ToLower(filepath.Ext(path))]; s != nil {
+		return s
+	}
+	if !bytes.HasPrefix(first, []byte("#!")) {
+		return nil
+	}
+	fields := strings.Fields(string(first[2:]))
+	if len(fields) == 0 {
+		return nil
+	}
+	interp := filepath.Base(fields[0])
+	if interp == "env" && len(fields) > 1 {
+		interp = fields[1]
+	}
+	switch {
+	case strings.HasPrefix(interp, "python"):
+		return syntaxPython
+	case interp == "sh" || strings.HasSuffix(interp, "sh"):
+		return syntaxShell
+	}
+	return nil
+}
+
+// ------------------
+
+func isWordByte(c byte) bool {
+	return c == '_' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c >= 0x80
+}
+
+func isDigit(c byte) bool {
+	return c >= '0' && c <= '9'
+}
+
+func fillClass(cls []syntaxClass, from, to int, c syntaxClass) {
+	for i := from; i < to && i < len(cls); i++ {
+		cls[i] = c
+	}
+}
+
+// skipString returns where the string starting with the quote at i
+// ends, or the end of the line if it isn't closed
+func skipString(line []byte, i int) int {
+	q := line[i]
+	for i++; i < len(line); i++ {
+		if line[i] == '\\' {
+			i++
+		} else if line[i] == q {
+			return i + 1
+		}
+	}
+	return len(line)
+}
+
+// closeState finds the end of the block comment or string the line
+// starts in. Returns where it ends and the state after it
+func (s *syntax) closeState(line []byte, state int) (int, int) {
+	var end string
+	switch state {
+	case synStateBlockComment:
+		end = s.blockEnd
+	case synStateRawString:
+		end = string(s.rawQuote)
+	case synStateTriple2:
+		end = `"""`
+	case synStateTriple1:
+		end = `'''`
+	default:
+		return 0, state
+	}
+	if i := bytes.Index(line, []byte(end)); i >= 0 {
+		return i + len(end), synStateNormal
+	}
+	return len(line), state
+}
+
+// highlightCode highlights languages made of words, strings and comments
+func highlightCode(s *syntax, line []byte, state int) ([]syntaxClass, int) {
+	cls := make([]syntaxClass, len(line))
+	i := 0
+	for i < len(line) {
+		if state != synStateNormal {
+			class := synString
+			if state == synStateBlockComment {
+				class = synComment
+			}
+			end, next := s.closeState(line[i:], state)
+			fillClass(cls, i, i+end, class)
+			i, state = i+end, next
+			continue
+		}
+		c := line[i]
+		rest := line[i:]
+		switch {
+		case s.lineComment != "" && bytes.HasPrefix(rest, []byte(s.lineComment)) &&
+			(!s.variables || i == 0 || line[i-1] == ' ' || line[i-1] == '\t'):
+			fillClass(cls, i, len(line), synComment)
+			return cls, state
+		case s.blockStart != "" && bytes.HasPrefix(rest, []byte(s.blockStart)):
+			fillClass(cls, i, i+len(s.blockStart), synComment)
+			i += len(s.blockStart)
+			state = synStateBlockComment
+		case s.triple && (bytes.HasPrefix(rest, []byte(`"""`)) || bytes.HasPrefix(rest, []byte(`'''`))):
+			fillClass(cls, i, i+3, synString)
+			i += 3
+			state = synStateTriple2
+			if c == '\'' {
+				state = synStateTriple1
+			}
+		case s.rawQuote != 0 && c == s.rawQuote:
+			fillClass(cls, i, i+1, synString)
+			i++
+			state = synStateRawString
+		case strings.IndexByte(s.quotes, c) >= 0:
+			end := skipString(line, i)
+			class := synString
+			if s.keys && bytes.HasPrefix(bytes.TrimLeft(line[end:], " \t"), []byte(":")) {
+				class = synKey
+			}
+			fillClass(cls, i, end, class)
+			i = end
+		case s.preproc && c == '#' && len(bytes.TrimSpace(line[:i])) == 0:
+			// The rest of the line, except comments
+			end := len(line)
+			if k := bytes.Index(rest, []byte("//")); k >= 0 {
+				end = i + k
+			}
+			fillClass(cls, i, end, synPreproc)
+			i = end
+		case s.variables && c == '$' && i+1 < len(line):
+			end := i + 1
+			if line[end] == '{' {
+				if k := bytes.IndexByte(line[end:], '}'); k >= 0 {
+					end += k + 1
+				}
+			} else {
+				for end < len(line) && isWordByte(line[end]) {
+					end++
+				}
+				if end == i+1 {
+					// $?, $#, $@...
+					end++
+				}
+			}
+			fillClass(cls, i, end, synVariable)
+			i = end
+		case isDigit(c) || c == '-' && s.keys && i+1 < len(line) && isDigit(line[i+1]):
+			end := i + 1
+			for end < len(line) && (isWordByte(line[end]) || line[end] == '.') {
+				end++
+			}
+			if i == 0 || !isWordByte(line[i-1]) {
+				fillClass(cls, i, end, synNumber)
+			}
+			i = end
+		case isWordByte(c):
+			end := i + 1
+			for end < len(line) && isWordByte(line[end]) {
+				end++
+			}
+			word := string(line[i:end])
+			if s.keywords[word] {
+				fillClass(cls, i, end, synKeyword)
+			} else if s.types[word] {
+				fillClass(cls, i, end, synType)
+			}
+			i = end
+		default:
+			i++
+		}
+	}
+	return cls, state
+}
+
+// highlightYAML highlights the key of a line, then the value as code
+func highlightYAML(s *syntax, line []byte, state int) ([]syntaxClass, int) {
+	trimmed := bytes.TrimLeft(line, " \t")
+	indent := len(line) - len(trimmed)
+	if bytes.Equal(trimmed, []byte("---")) || bytes.Equal(trimmed, []byte("...")) {
+		cls := make([]syntaxClass, len(line))
+		fillClass(cls, indent, len(line), synMeta)
+		return cls, state
+	}
+	// List items
+	for bytes.HasPrefix(trimmed, []byte("- ")) {
+		trimmed = bytes.TrimLeft(trimmed[2:], " ")
+	}
+	start := len(line) - len(trimmed)
+	keyEnd := -1
+	if len(trimmed) > 0 && trimmed[0] != '#' && trimmed[0] != '"' && trimmed[0] != '\'' {
+		for k := 0; k < len(trimmed); k++ {
+			if trimmed[k] == ':' && (k+1 == len(trimmed) || trimmed[k+1] == ' ' || trimmed[k+1] == '\t') {
+				keyEnd = start + k
+				break
+			}
+		}
+	}
+	if keyEnd < 0 {
+		return highlightCode(s, line, state)
+	}
+	rest, _ := highlightCode(s, line[keyEnd+1:], state)
+	cls := make([]syntaxClass, len(line))
+	fillClass(cls, start, keyEnd, synKey)
+	copy(cls[keyEnd+1:], rest)
+	return cls, state
+}
+
+// highlightMarkdown highlights headings, quotes, lists, code blocks
+// and inline code
+func highlightMarkdown(s *syntax, line []byte, state int) ([]syntaxClass, int) {
+	cls := make([]syntaxClass, len(line))
+	trimmed := bytes.TrimLeft(line, " ")
+	indent := len(line) - len(trimmed)
+	if bytes.HasPrefix(trimmed, []byte("```")) || bytes.HasPrefix(trimmed, []byte("~~~")) {
+		fillClass(cls, indent, len(line), synMeta)
+		if state == synStateFence {
+			return cls, synStateNormal
+		}
+		return cls, synStateFence
+	}
+	if state == synStateFence {
+		fillClass(cls, 0, len(line), synString)
+		return cls, state
+	}
+	switch {
+	case bytes.HasPrefix(trimmed, []byte("#")):
+		fillClass(cls, indent, len(line), synHeading)
+		return cls, state
+	case bytes.HasPrefix(trimmed, []byte(">")):
+		fillClass(cls, indent, len(line), synComment)
+		return cls, state
+	case bytes.HasPrefix(trimmed, []byte("- ")) || bytes.HasPrefix(trimmed, []byte("* ")) || bytes.HasPrefix(trimmed, []byte("+ ")):
+		fillClass(cls, indent, indent+1, synKeyword)
+	default:
+		k := 0
+		for k < len(trimmed) && isDigit(trimmed[k]) {
+			k++
+		}
+		if k > 0 && k+1 < len(trimmed) && trimmed[k] == '.' && trimmed[k+1] == ' ' {
+			fillClass(cls, indent, indent+k+1, synKeyword)
+		}
+	}
+	// Inline code
+	for i := 0; i < len(line); i++ {
+		if line[i] != '`' {
+			continue
+		}
+		end := bytes.IndexByte(line[i+1:], '`')
+		if end < 0 {
+			break
+		}
+		fillClass(cls, i, i+end+2, synString)
+		i += end + 1
+	}
+	return cls, state
+}
+
+// highlightDiff highlights added and removed lines, and headers
+func highlightDiff(s *syntax, line []byte, state int) ([]syntaxClass, int) {
+	cls := make([]syntaxClass, len(line))
+	class := synNone
+	switch {
+	case bytes.HasPrefix(line, []byte("+++ ")) || bytes.HasPrefix(line, []byte("--- ")) ||
+		bytes.HasPrefix(line, []byte("diff ")) || bytes.HasPrefix(line, []byte("index ")):
+		class = synHeading
+	case bytes.HasPrefix(line, []byte("@@")):
+		class = synMeta
+	case bytes.HasPrefix(line, []byte("+")):
+		class = synAdded
+	case bytes.HasPrefix(line, []byte("-")):
+		class = synRemoved
+	}
+	fillClass(cls, 0, len(line), class)
+	return cls, state
+}
@@ -2,7 +2,13 @@
 
 package main
 
-import "os/exec"
+import (
+	"os"
+	"os/exec"
+	"runtime"
+	"syscall"
+	"unsafe"
+)
 
 // GetDrives returns a map of drive letters. *nix systems dont have drives, so empty list
 func GetDrives() (map[rune]bool, error) {
@@ -12,3 +18,82 @@ func GetDrives() (map[rune]bool, error) {
 // SetProcCmdline dummy, only needed on Windows
 func SetProcCmdline(cmd *exec.Cmd, cmdline string) {
 }
+
+// IsCrossDevice returns true if err comes from a rename that failed
+// because the source and target are in different file systems
+func IsCrossDevice(err error) bool {
+	if le, ok := err.(*os.LinkError); ok {
+		err = le.Err
+	}
+	return err == syscall.EXDEV
+}
+
+// SameDevice returns true if path is in the same file system as the
+// folder dir, so moving it there is just a rename
+func SameDevice(path string, dir string) bool {
+	a, err := os.Lstat(path)
+	if err != nil {
+		return false
+	}
+	b, err := os.Stat(dir)
+	if err != nil {
+		return false
+	}
+	sa, ok := a.Sys().(*syscall.Stat_t)
+	sb, ok2 := b.Sys().(*syscall.Stat_t)
+	return ok && ok2 && sa.Dev == sb.Dev
+}
+
+// OpenerCommand returns the program that opens files with the desktop's
+// default application for them, or nil if there's no desktop
+func OpenerCommand() []string {
+	if runtime.GOOS == "darwin" {
+		return []string{"open"}
+	}
+	if os.Getenv("DISPLAY") == "" && os.Getenv("WAYLAND_DISPLAY") == "" {
+		return nil
+	}
+	if _, err := exec.LookPath("xdg-open"); err != nil {
+		return nil
+	}
+	return []string{"xdg-open"}
+}
+
+// DetachCommand makes the command run in its own session, so it's not
+// killed with jm or by signals sent to the terminal
+func DetachCommand(cmd *exec.Cmd) {
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setsid: true}
+}
+
+// ChildSignals are the signals sent by the terminal's control keys,
+// which jm must survive while it runs other programs
+var ChildSignals = []os.Signal{os.Interrupt, syscall.SIGQUIT}
+
+// SaveTerminal records the settings of the terminal, and returns a
+// function that sets them back
+func SaveTerminal() func() {
+	tty, err := os.OpenFile("/dev/tty", os.O_RDWR, 0)
+	if err != nil {
+		return func() {}
+	}
+	var state syscall.Termios
+	if _, _, e := syscall.Syscall(syscall.SYS_IOCTL, tty.Fd(), ioctlGetTermios, uintptr(unsafe.Pointer(&state))); e != 0 {
+		tty.Close()
+		return func() {}
+	}
+	return func() {
+		syscall.Syscall(syscall.SYS_IOCTL, tty.Fd(), ioctlSetTermios, uintptr(unsafe.Pointer(&state)))
+		tty.Close()
+	}
+}
+
+// SetProcessGroup makes the command start a process group, so
+// KillProcessGroup can kill it with the processes it starts
+func SetProcessGroup(cmd *exec.Cmd) {
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+}
+
+// KillProcessGroup kills a started command and the processes it started
+func KillProcessGroup(cmd *exec.Cmd) error {
+	return syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+}
@@ -3,7 +3,11 @@
 package main
 
 import (
+	"os"
 	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
 	"syscall"
 )
 
@@ -38,3 +42,68 @@ func SetProcCmdline(cmd *exec.Cmd, cmdline string) {
 	cmd.SysProcAttr = new(syscall.SysProcAttr)
 	cmd.SysProcAttr.CmdLine = cmdline
 }
+
+// Not defined by the syscall package
+const errorNotSameDevice syscall.Errno = 17
+
+// IsCrossDevice returns true if err comes from a rename that failed
+// because the source and target are in different volumes
+func IsCrossDevice(err error) bool {
+	if le, ok := err.(*os.LinkError); ok {
+		err = le.Err
+	}
+	return err == errorNotSameDevice
+}
+
+// SameDevice returns true if path is in the same volume as the folder
+// dir, so moving it there is just a rename
+func SameDevice(path string, dir string) bool {
+	a, err := filepath.Abs(path)
+	if err != nil {
+		return false
+	}
+	b, err := filepath.Abs(dir)
+	if err != nil {
+		return false
+	}
+	return strings.EqualFold(filepath.VolumeName(a), filepath.VolumeName(b))
+}
+
+// OpenerCommand returns the program that opens files with their
+// default application
+func OpenerCommand() []string {
+	return []string{"rundll32", "url.dll,FileProtocolHandler"}
+}
+
+// Not defined by the syscall package
+const detachedProcess = 0x00000008
+
+// DetachCommand makes the command run without a console, so it's not
+// killed with jm or by Ctrl+C
+func DetachCommand(cmd *exec.Cmd) {
+	cmd.SysProcAttr = &syscall.SysProcAttr{CreationFlags: detachedProcess | syscall.CREATE_NEW_PROCESS_GROUP}
+}
+
+// ChildSignals are the signals sent by the console's control keys,
+// which jm must survive while it runs other programs
+var ChildSignals = []os.Signal{os.Interrupt}
+
+// SaveTerminal is not needed on Windows, termbox sets the console
+// mode again when it starts
+func SaveTerminal() func() {
+	return func() {}
+}
+
+// SetProcessGroup makes the command start a process group, so
+// KillProcessGroup can kill it with the processes it starts
+func SetProcessGroup(cmd *exec.Cmd) {
+	if cmd.SysProcAttr == nil {
+		cmd.SysProcAttr = new(syscall.SysProcAttr)
+	}
+	cmd.SysProcAttr.CreationFlags |= syscall.CREATE_NEW_PROCESS_GROUP
+}
+
+// KillProcessGroup kills a started command and the processes it started
+func KillProcessGroup(cmd *exec.Cmd) error {
+	return exec.Command("taskkill", "/T", "/F", "/PID", strconv.Itoa(cmd.Process.Pid)).Run()
+}
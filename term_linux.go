@@ -0,0 +1,11 @@
+// +build linux
+
+package main
+
+import "syscall"
+
+// ioctls to read and set the terminal settings
+const (
+	ioctlGetTermios = syscall.TCGETS
+	ioctlSetTermios = syscall.TCSETS
+)
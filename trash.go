@@ -0,0 +1,119 @@
+// Copyright 2017 Javier Arevalo <jare@iguanademos.com>
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+// http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Browsing and restoring the trash. The platform specific parts
+// are in trash_nix.go and trash_windows.go
+
+package main
+
+import (
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/nsf/termbox-go"
+)
+
+// TrashItem is a file or folder stored in a trash folder
+type TrashItem struct {
+	// Name of the entry inside the trash
+	Name         string
+	OriginalPath string
+	DeletionDate time.Time
+	// Trash folder holding the entry
+	Trash string
+}
+
+// trashView lists the trashed files so they can be restored
+type trashView struct {
+	items  []TrashItem
+	top    int
+	cursor int
+}
+
+func newTrashView() (*trashView, error) {
+	items, err := ListTrash([]string{ap.Cwd, op.Cwd})
+	if err != nil {
+		return nil, err
+	}
+	// Most recent first
+	sort.Slice(items, func(i, j int) bool {
+		return items[i].DeletionDate.After(items[j].DeletionDate)
+	})
+	return &trashView{items: items}, nil
+}
+
+func (v *trashView) Render(w, h int) {
+	h -= 2
+	drawBox(0, 0, w, h, fmt.Sprintf("Trash (%d items)", len(v.items)))
+	rows := h - 1
+	if v.cursor >= len(v.items) {
+		v.cursor = len(v.items) - 1
+	}
+	if v.cursor < 0 {
+		v.cursor = 0
+	}
+	if v.cursor < v.top {
+		v.top = v.cursor
+	} else if v.cursor >= v.top+rows {
+		v.top = v.cursor - rows + 1
+	}
+	for i := 0; i < rows && v.top+i < len(v.items); i++ {
+		item := &v.items[v.top+i]
+		fg, bg := termbox.ColorDefault, termbox.ColorDefault
+		if v.top+i == v.cursor {
+			fg, bg = termbox.ColorBlack, termbox.ColorGreen
+		}
+		fill(0, 1+i, w, 1, termbox.Cell{Ch: ' ', Bg: bg})
+		tbprintw(0, 1+i, w, fg, bg, fmt.Sprintf("%s  %s", item.DeletionDate.Format("02 Jan 2006 15:04:05"), item.OriginalPath))
+	}
+	if len(v.items) == 0 {
+		tbprint(1, 1, termbox.ColorDefault, termbox.ColorDefault, "The trash is empty")
+	}
+}
+
+func (v *trashView) HandleKey(ev termbox.Event) bool {
+	if ev.Key == termbox.KeyEsc || ev.Ch == 'q' || ev.Ch == 't' {
+		return false
+	} else if ev.Key == termbox.KeyArrowUp || ev.Ch == 'k' {
+		v.cursor--
+	} else if ev.Key == termbox.KeyArrowDown || ev.Ch == 'j' {
+		v.cursor++
+	} else if ev.Key == termbox.KeyPgup || ev.Ch == 'u' {
+		v.cursor -= 20
+	} else if ev.Key == termbox.KeyPgdn || ev.Ch == 'i' {
+		v.cursor += 20
+	} else if ev.Key == termbox.KeyHome || ev.Ch == 'U' {
+		v.cursor = 0
+	} else if ev.Key == termbox.KeyEnd || ev.Ch == 'I' {
+		v.cursor = len(v.items) - 1
+	} else if ev.Key == termbox.KeyEnter || ev.Ch == 'r' {
+		if v.cursor < len(v.items) {
+			item := v.items[v.cursor]
+			if err := RestoreFromTrash(item); err != nil {
+				status = err.Error()
+			} else {
+				status = "Restored " + item.OriginalPath
+				v.items = append(v.items[:v.cursor], v.items[v.cursor+1:]...)
+				ap.Refresh()
+				op.Refresh()
+			}
+		}
+	}
+	return true
+}
+
+func (v *trashView) Help() string {
+	return "[ESC,q,t close] [ARROWS nav] [ENTER,r Restore to original location]"
+}
@@ -0,0 +1,291 @@
+// +build !windows
+
+// Copyright 2017 Javier Arevalo <jare@iguanademos.com>
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+// http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Trash following the FreeDesktop.org trash specification:
+// https://specifications.freedesktop.org/trash-spec/trashspec-latest.html
+
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/mitchellh/go-homedir"
+)
+
+const trashInfoExt = ".trashinfo"
+const trashDateFormat = "2006-01-02T15:04:05"
+
+// homeTrash returns the trash folder in the user's home
+func homeTrash() string {
+	data := os.Getenv("XDG_DATA_HOME")
+	if data == "" {
+		home, _ := homedir.Dir()
+		data = filepath.Join(home, ".local", "share")
+	}
+	return filepath.Join(data, "Trash")
+}
+
+func deviceOf(path string) (uint64, error) {
+	var st syscall.Stat_t
+	if err := syscall.Lstat(path, &st); err != nil {
+		return 0, err
+	}
+	return uint64(st.Dev), nil
+}
+
+// mountPoint returns the top folder of the file system holding path
+func mountPoint(path string) (string, error) {
+	dev, err := deviceOf(path)
+	if err != nil {
+		return "", err
+	}
+	for {
+		parent := filepath.Dir(path)
+		if parent == path {
+			return path, nil
+		}
+		pdev, err := deviceOf(parent)
+		if err != nil || pdev != dev {
+			return path, nil
+		}
+		path = parent
+	}
+}
+
+// topdirTrash returns the trash folder to use at the top of a mount,
+// creating it if needed. $topdir/.Trash/$uid is used if the admin set up
+// $topdir/.Trash as the spec requires, otherwise $topdir/.Trash-$uid
+func topdirTrash(topdir string) (string, error) {
+	uid := strconv.Itoa(os.Getuid())
+	shared := filepath.Join(topdir, ".Trash")
+	if st, err := os.Lstat(shared); err == nil && st.IsDir() && st.Mode()&os.ModeSticky != 0 {
+		dir := filepath.Join(shared, uid)
+		if err = os.MkdirAll(dir, 0700); err == nil {
+			return dir, nil
+		}
+	}
+	dir := filepath.Join(topdir, ".Trash-"+uid)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return "", err
+	}
+	st, err := os.Lstat(dir)
+	if err != nil {
+		return "", err
+	}
+	if !st.IsDir() || st.Mode()&os.ModeSymlink != 0 {
+		return "", fmt.Errorf("%s is not a valid trash folder", dir)
+	}
+	return dir, nil
+}
+
+// trashFor returns the trash folder where path should go, and the
+// mount top folder that paths in that trash are relative to (empty
+// for the home trash, where they are absolute)
+func trashFor(path string) (string, string, error) {
+	home := homeTrash()
+	if err := os.MkdirAll(home, 0700); err != nil {
+		return "", "", err
+	}
+	homeDev, err := deviceOf(home)
+	if err != nil {
+		return "", "", err
+	}
+	dev, err := deviceOf(path)
+	if err != nil {
+		return "", "", err
+	}
+	if dev == homeDev {
+		return home, "", nil
+	}
+	topdir, err := mountPoint(path)
+	if err != nil {
+		return "", "", err
+	}
+	trash, err := topdirTrash(topdir)
+	if err != nil {
+		return "", "", fmt.Errorf("No usable trash for %s: %s", path, err)
+	}
+	return trash, topdir, nil
+}
+
+// MoveToTrash moves a file or folder into the trash of its file system,
+// returning the trash entry created for it
+func MoveToTrash(path string) (TrashItem, error) {
+	path = filepath.Clean(path)
+	dir := filepath.Dir(path)
+	if dir[len(dir)-1] == os.PathSeparator {
+		return TrashItem{}, fmt.Errorf("Deleting %s from root folder not allowed for safety", path)
+	}
+	trash, topdir, err := trashFor(path)
+	if err != nil {
+		return TrashItem{}, err
+	}
+	filesDir, infoDir := filepath.Join(trash, "files"), filepath.Join(trash, "info")
+	if err = os.MkdirAll(filesDir, 0700); err != nil {
+		return TrashItem{}, err
+	}
+	if err = os.MkdirAll(infoDir, 0700); err != nil {
+		return TrashItem{}, err
+	}
+
+	original := path
+	if topdir != "" {
+		original, _ = filepath.Rel(topdir, path)
+	}
+	now := time.Now()
+	info := fmt.Sprintf("[Trash Info]\nPath=%s\nDeletionDate=%s\n", (&url.URL{Path: original}).EscapedPath(), now.Format(trashDateFormat))
+
+	// Creating the info file exclusively reserves the name in the trash,
+	// as long as files has no entry left by that name without its info,
+	// which the rename would replace
+	base := filepath.Base(path)
+	name := base
+	var f *os.File
+	for i := 2; ; i++ {
+		f, err = os.OpenFile(filepath.Join(infoDir, name+trashInfoExt), os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+		if err == nil {
+			_, err = os.Lstat(filepath.Join(filesDir, name))
+			if os.IsNotExist(err) {
+				break
+			}
+			f.Close()
+			os.Remove(f.Name())
+			if err != nil {
+				return TrashItem{}, err
+			}
+		} else if !os.IsExist(err) {
+			return TrashItem{}, err
+		}
+		name = fmt.Sprintf("%s.%d", base, i)
+	}
+	infoFile := f.Name()
+	_, err = f.WriteString(info)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(path, filepath.Join(filesDir, name))
+	}
+	if err != nil {
+		os.Remove(infoFile)
+		return TrashItem{}, err
+	}
+	return TrashItem{Name: name, OriginalPath: path, DeletionDate: now, Trash: trash}, nil
+}
+
+// readTrashInfo parses a .trashinfo file
+func readTrashInfo(trash string, topdir string, infoFile string) (TrashItem, error) {
+	item := TrashItem{Name: strings.TrimSuffix(filepath.Base(infoFile), trashInfoExt), Trash: trash}
+	f, err := os.Open(infoFile)
+	if err != nil {
+		return item, err
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if strings.HasPrefix(line, "Path=") {
+			p, err := url.PathUnescape(line[len("Path="):])
+			if err != nil {
+				return item, err
+			}
+			if !filepath.IsAbs(p) {
+				p = filepath.Join(topdir, p)
+			}
+			item.OriginalPath = p
+		} else if strings.HasPrefix(line, "DeletionDate=") {
+			item.DeletionDate, _ = time.ParseInLocation(trashDateFormat, line[len("DeletionDate="):], time.Local)
+		}
+	}
+	if item.OriginalPath == "" {
+		return item, fmt.Errorf("%s has no original path", infoFile)
+	}
+	return item, scanner.Err()
+}
+
+// ListTrash returns the contents of the home trash and of the trashes
+// in the file systems holding the given paths
+func ListTrash(paths []string) ([]TrashItem, error) {
+	type trashDir struct{ dir, topdir string }
+	dirs := []trashDir{{homeTrash(), ""}}
+	uid := strconv.Itoa(os.Getuid())
+	for _, p := range paths {
+		topdir, err := mountPoint(p)
+		if err != nil {
+			continue
+		}
+		dirs = append(dirs, trashDir{filepath.Join(topdir, ".Trash", uid), topdir})
+		dirs = append(dirs, trashDir{filepath.Join(topdir, ".Trash-"+uid), topdir})
+	}
+	var items []TrashItem
+	seen := make(map[string]bool)
+	for _, d := range dirs {
+		if seen[d.dir] {
+			continue
+		}
+		seen[d.dir] = true
+		infos, err := ioutil.ReadDir(filepath.Join(d.dir, "info"))
+		if err != nil {
+			continue
+		}
+		for _, info := range infos {
+			if !strings.HasSuffix(info.Name(), trashInfoExt) {
+				continue
+			}
+			item, err := readTrashInfo(d.dir, d.topdir, filepath.Join(d.dir, "info", info.Name()))
+			if err != nil {
+				Logf("Bad trash entry: %s\n", err)
+				continue
+			}
+			if _, err = os.Lstat(item.file()); err == nil {
+				items = append(items, item)
+			}
+		}
+	}
+	return items, nil
+}
+
+// TrashRestorable tells if RestoreFromTrash works, so trashing
+// files can be undone
+const TrashRestorable = true
+
+// RestoreFromTrash moves a trashed file back to its original location,
+// which must not exist
+func RestoreFromTrash(item TrashItem) error {
+	if _, err := os.Lstat(item.OriginalPath); err == nil {
+		return fmt.Errorf("Can't restore %s: a file with that name exists", item.OriginalPath)
+	}
+	if err := os.MkdirAll(filepath.Dir(item.OriginalPath), 0755); err != nil {
+		return err
+	}
+	if err := os.Rename(item.file(), item.OriginalPath); err != nil {
+		return err
+	}
+	return os.Remove(filepath.Join(item.Trash, "info", item.Name+trashInfoExt))
+}
+
+func (item *TrashItem) file() string {
+	return filepath.Join(item.Trash, "files", item.Name)
+}
@@ -0,0 +1,84 @@
+// +build windows
+
+// Copyright 2017 Javier Arevalo <jare@iguanademos.com>
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+// http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Trash support via the Windows Recycle Bin
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+	"syscall"
+	"time"
+	"unsafe"
+)
+
+const (
+	foDelete          = 3
+	fofSilent         = 0x0004
+	fofNoConfirmation = 0x0010
+	fofAllowUndo      = 0x0040
+	fofNoErrorUI      = 0x0400
+)
+
+// TrashRestorable tells if RestoreFromTrash works, so trashing
+// files can be undone
+const TrashRestorable = false
+
+// MoveToTrash moves a file or folder into the Recycle Bin
+func MoveToTrash(path string) (TrashItem, error) {
+	path = filepath.Clean(path)
+	dir := filepath.Dir(path)
+	if dir[len(dir)-1] == os.PathSeparator {
+		return TrashItem{}, fmt.Errorf("Deleting %s from root folder not allowed for safety", path)
+	}
+	shell32, err := syscall.LoadDLL("shell32.dll")
+	if err != nil {
+		return TrashItem{}, err
+	}
+	shFileOperation, err := shell32.FindProc("SHFileOperationW")
+	if err != nil {
+		return TrashItem{}, err
+	}
+	// The list of files must end with two NULs
+	from, err := syscall.UTF16FromString(path)
+	if err != nil {
+		return TrashItem{}, err
+	}
+	from = append(from, 0)
+	op := newShFileOp(foDelete, &from[0], fofAllowUndo|fofNoConfirmation|fofSilent|fofNoErrorUI)
+	ret, _, _ := shFileOperation.Call(uintptr(unsafe.Pointer(op)))
+	runtime.KeepAlive(from)
+	if ret != 0 {
+		return TrashItem{}, fmt.Errorf("Moving %s to the Recycle Bin failed with error 0x%x", path, ret)
+	}
+	if op.aborted() {
+		return TrashItem{}, fmt.Errorf("Moving %s to the Recycle Bin was aborted", path)
+	}
+	return TrashItem{OriginalPath: path, DeletionDate: time.Now()}, nil
+}
+
+// ListTrash is not supported, the Recycle Bin is managed from Explorer
+func ListTrash(paths []string) ([]TrashItem, error) {
+	return nil, fmt.Errorf("Browsing the Recycle Bin is not supported, use Explorer to restore files")
+}
+
+// RestoreFromTrash is not supported, the Recycle Bin is managed from Explorer
+func RestoreFromTrash(item TrashItem) error {
+	return fmt.Errorf("Restoring from the Recycle Bin is not supported, use Explorer to restore files")
+}
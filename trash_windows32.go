@@ -0,0 +1,44 @@
+// +build windows,386 windows,arm
+
+// Copyright 2017 Javier Arevalo <jare@iguanademos.com>
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+// http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Layout of the Recycle Bin call struct on 32 bit Windows
+
+package main
+
+import (
+	"encoding/binary"
+	"unsafe"
+)
+
+// SHFILEOPSTRUCTW is packed to 1 byte on 32 bit Windows, which Go
+// structs can't express, so its fields are placed by hand:
+// hwnd 0, wFunc 4, pFrom 8, pTo 12, fFlags 16, fAnyOperationsAborted 18,
+// hNameMappings 22, lpszProgressTitle 26
+type shFileOpStruct [30]byte
+
+// newShFileOp fills in the struct. The caller must keep from alive
+// until the call is done, since the struct hides the pointer
+func newShFileOp(wFunc uint32, from *uint16, flags uint16) *shFileOpStruct {
+	var op shFileOpStruct
+	binary.LittleEndian.PutUint32(op[4:], wFunc)
+	binary.LittleEndian.PutUint32(op[8:], uint32(uintptr(unsafe.Pointer(from))))
+	binary.LittleEndian.PutUint16(op[16:], flags)
+	return &op
+}
+
+func (op *shFileOpStruct) aborted() bool {
+	return binary.LittleEndian.Uint32(op[18:]) != 0
+}
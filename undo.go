@@ -0,0 +1,333 @@
+// Copyright 2017 Javier Arevalo <jare@iguanademos.com>
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+// http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Undo/redo journal of the completed file operations
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+type undoKind int
+
+const (
+	// From was moved or renamed to To
+	undoMove undoKind = iota
+	// From was copied to To, which didn't exist
+	undoCopy
+	// The folder To was created
+	undoMkdir
+	// The empty file To was created
+	undoTouch
+	// From was moved to the trash, as Trash
+	undoTrash
+)
+
+// fileStamp is what we remember about a file to check that it hasn't
+// changed before undoing or redoing an operation on it
+type fileStamp struct {
+	Type    os.FileMode
+	Size    int64
+	ModTime time.Time
+}
+
+// staleError tells that a file is not as an undo record describes it
+// anymore, so the record can't be undone or redone
+type staleError struct {
+	err error
+}
+
+func (e *staleError) Error() string {
+	return e.err.Error()
+}
+
+func stampOf(path string) fileStamp {
+	st, err := os.Lstat(path)
+	if err != nil {
+		return fileStamp{}
+	}
+	return fileStamp{st.Mode().Type(), st.Size(), st.ModTime()}
+}
+
+// check returns an error if path is not the file the stamp describes.
+// Folders are only checked by type, since their contents may change
+func (s fileStamp) check(path string) error {
+	st, err := os.Lstat(path)
+	if err != nil {
+		return &staleError{err}
+	}
+	if st.Mode().Type() != s.Type {
+		return &staleError{fmt.Errorf("%s has changed type", path)}
+	}
+	if !st.IsDir() && (st.Size() != s.Size || !st.ModTime().Equal(s.ModTime)) {
+		return &staleError{fmt.Errorf("%s has been modified", path)}
+	}
+	return nil
+}
+
+func mustNotExist(path string) error {
+	if _, err := os.Lstat(path); err == nil {
+		return &staleError{fmt.Errorf("%s already exists", path)}
+	}
+	return nil
+}
+
+// undoRecord describes a single completed operation on a file
+type undoRecord struct {
+	Kind  undoKind
+	From  string
+	To    string
+	Stamp fileStamp
+	Trash TrashItem
+}
+
+// newUndoRecord creates a record for an operation that just completed,
+// stamping the file it resulted in
+func newUndoRecord(kind undoKind, from string, to string) undoRecord {
+	r := undoRecord{Kind: kind, From: from, To: to}
+	r.Stamp = stampOf(to)
+	return r
+}
+
+func newTrashRecord(item TrashItem, stamp fileStamp) undoRecord {
+	return undoRecord{Kind: undoTrash, From: item.OriginalPath, Stamp: stamp, Trash: item}
+}
+
+// Path returns the file the record is about, for progress messages
+func (r *undoRecord) Path() string {
+	if r.Kind == undoTrash {
+		return r.From
+	}
+	return r.To
+}
+
+// undoMoveFile renames from to to, copying across file systems if needed.
+// The folder of to is created again if a move merged it away
+func undoMoveFile(ctx context.Context, from string, to string) error {
+	if err := os.MkdirAll(filepath.Dir(to), 0777); err != nil {
+		return err
+	}
+	m := mover{copier{ctx: ctx}}
+	if m.moveEntry(from, to) == "" && m.err() == nil {
+		return fmt.Errorf("Could not move %s to %s", from, to)
+	}
+	return m.err()
+}
+
+// undo reverts the operation, after checking that the files
+// are still as the operation left them
+func (r *undoRecord) undo(ctx context.Context) error {
+	switch r.Kind {
+	case undoMove:
+		if err := r.Stamp.check(r.To); err != nil {
+			return err
+		}
+		if err := mustNotExist(r.From); err != nil {
+			return err
+		}
+		return undoMoveFile(ctx, r.To, r.From)
+	case undoCopy, undoTouch:
+		if err := r.Stamp.check(r.To); err != nil {
+			return err
+		}
+		// The copy goes to the trash, just in case
+		_, err := MoveToTrash(r.To)
+		return err
+	case undoMkdir:
+		if err := r.Stamp.check(r.To); err != nil {
+			return err
+		}
+		// Fails if the folder is not empty anymore
+		return os.Remove(r.To)
+	case undoTrash:
+		if err := mustNotExist(r.From); err != nil {
+			return err
+		}
+		return RestoreFromTrash(r.Trash)
+	}
+	return fmt.Errorf("Unknown operation %d", r.Kind)
+}
+
+// redo performs the operation again, after checking that the files
+// are still as undoing it left them
+func (r *undoRecord) redo(ctx context.Context) error {
+	switch r.Kind {
+	case undoMove:
+		if err := r.Stamp.check(r.From); err != nil {
+			return err
+		}
+		if err := mustNotExist(r.To); err != nil {
+			return err
+		}
+		return undoMoveFile(ctx, r.From, r.To)
+	case undoCopy:
+		if err := mustNotExist(r.To); err != nil {
+			return err
+		}
+		c := copier{ctx: ctx}
+		c.copyEntry(r.From, r.To)
+		c.setDirModes()
+		if err := c.err(); err != nil {
+			return err
+		}
+		r.Stamp = stampOf(r.To)
+		return nil
+	case undoTouch:
+		if err := mustNotExist(r.To); err != nil {
+			return err
+		}
+		f, err := os.OpenFile(r.To, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0666)
+		if err != nil {
+			return err
+		}
+		f.Close()
+		r.Stamp = stampOf(r.To)
+		return nil
+	case undoMkdir:
+		if err := mustNotExist(r.To); err != nil {
+			return err
+		}
+		if err := os.Mkdir(r.To, 0777); err != nil {
+			return err
+		}
+		r.Stamp = stampOf(r.To)
+		return nil
+	case undoTrash:
+		if err := r.Stamp.check(r.From); err != nil {
+			return err
+		}
+		item, err := MoveToTrash(r.From)
+		if err != nil {
+			return err
+		}
+		r.Trash = item
+		return nil
+	}
+	return fmt.Errorf("Unknown operation %d", r.Kind)
+}
+
+// undoEntry groups the records of one user command, which are
+// undone and redone together
+type undoEntry struct {
+	Desc    string
+	Records []undoRecord
+}
+
+// undoJournal keeps the operations that can be undone and redone
+type undoJournal struct {
+	undo []*undoEntry
+	redo []*undoEntry
+}
+
+const maxUndo = 100
+
+var journal undoJournal
+
+// Push records a new completed command, which discards
+// the commands that could be redone
+func (u *undoJournal) Push(e *undoEntry) {
+	if len(e.Records) == 0 {
+		return
+	}
+	u.undo = append(u.undo, e)
+	if len(u.undo) > maxUndo {
+		u.undo = u.undo[1:]
+	}
+	u.redo = nil
+}
+
+// startUndo queues a job that undoes the last command
+func startUndo() {
+	if len(journal.undo) == 0 {
+		status = "Nothing to undo"
+		return
+	}
+	e := journal.undo[len(journal.undo)-1]
+	journal.undo = journal.undo[:len(journal.undo)-1]
+	// Undo in reverse order
+	reversed := &undoEntry{Desc: e.Desc}
+	for i := len(e.Records) - 1; i >= 0; i-- {
+		reversed.Records = append(reversed.Records, e.Records[i])
+	}
+	jobs.Add(newUndoJob(jobUndo, reversed))
+}
+
+// startRedo queues a job that redoes the last undone command
+func startRedo() {
+	if len(journal.redo) == 0 {
+		status = "Nothing to redo"
+		return
+	}
+	e := journal.redo[len(journal.redo)-1]
+	journal.redo = journal.redo[:len(journal.redo)-1]
+	jobs.Add(newUndoJob(jobRedo, e))
+}
+
+func newUndoJob(kind jobKind, e *undoEntry) *Job {
+	j := &Job{Kind: kind, Entry: e}
+	for _, r := range e.Records {
+		j.Files = append(j.Files, r.Path())
+	}
+	return j
+}
+
+// finishUndoJob puts the records that were successfully undone or redone
+// in the opposite stack. Records that failed their checks are dropped,
+// since the files aren't in the state they describe anymore. The rest,
+// cancelled or failed for other reasons, go back to the stack they came
+// from, so they can be tried again
+func finishUndoJob(j *Job) {
+	done := &undoEntry{Desc: j.Entry.Desc}
+	left := &undoEntry{Desc: j.Entry.Desc}
+	for i, r := range j.Entry.Records {
+		if j.Errs[i] == nil {
+			done.Records = append(done.Records, r)
+		} else if _, stale := j.Errs[i].(*staleError); !stale {
+			left.Records = append(left.Records, r)
+		}
+	}
+	if j.Kind == jobUndo {
+		// Back to the original order
+		reverseRecords(done.Records)
+		reverseRecords(left.Records)
+		if len(left.Records) > 0 {
+			journal.undo = append(journal.undo, left)
+			status = status + fmt.Sprintf(" %d operations not undone, press z to try again.", len(left.Records))
+		}
+		if len(done.Records) > 0 {
+			journal.redo = append(journal.redo, done)
+			status = status + " Undone: " + done.Desc
+		}
+	} else {
+		if len(left.Records) > 0 {
+			journal.redo = append(journal.redo, left)
+			status = status + fmt.Sprintf(" %d operations not redone, press Z to try again.", len(left.Records))
+		}
+		if len(done.Records) > 0 {
+			journal.undo = append(journal.undo, done)
+			status = status + " Redone: " + done.Desc
+		}
+	}
+}
+
+func reverseRecords(records []undoRecord) {
+	for i, k := 0, len(records)-1; i < k; i, k = i+1, k-1 {
+		records[i], records[k] = records[k], records[i]
+	}
+}
@@ -0,0 +1,216 @@
+// Copyright 2017 Javier Arevalo <jare@iguanademos.com>
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+// http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// User menu: commands defined in the config file, run from a popup menu
+
+package main
+
+import (
+	"fmt"
+	"unicode/utf8"
+
+	"github.com/mattn/go-runewidth"
+	"github.com/nsf/termbox-go"
+)
+
+// menuEntry is a command of the user menu. Key runs it from the menu,
+// and Command is a command line for the shell, with the placeholders
+// of the command prompt (see commandVars).
+// The entry is only shown when its conditions hold in the active panel:
+// the entry at the cursor matches Pattern (a glob for the name or a MIME
+// type, like in associations), it's a folder or not as Dir says, and
+// there are selected files if Selection is set.
+// Confirm asks before running the command. Output shows its output as
+// it runs; otherwise it runs in the background and the messages keep
+// its output
+type menuEntry struct {
+	Key       string
+	Label     string
+	Command   string
+	Pattern   string
+	Dir       *bool
+	Selection bool
+	Confirm   bool
+	Output    bool
+}
+
+var userMenu []menuEntry
+
+// Available returns whether the conditions of the entry hold in the
+// active panel
+func (m *menuEntry) Available() bool {
+	if m.Selection && ap.SelectedCount() == 0 {
+		return false
+	}
+	if m.Pattern == "" && m.Dir == nil {
+		return true
+	}
+	if ap.Cursor >= len(ap.Entries) {
+		return false
+	}
+	e := ap.Entries[ap.Cursor]
+	if m.Dir != nil && *m.Dir != e.IsDir() {
+		return false
+	}
+	if m.Pattern != "" {
+		name := ap.Path(e)
+		return matchPattern(m.Pattern, name, func() string { return mimeTypeOf(name) })
+	}
+	return true
+}
+
+// Run runs the command of the entry, asking first if it has to
+func (m *menuEntry) Run() {
+	command := expandCommandLine(m.Command, commandVars())
+	dir := ap.Cwd
+	run := func() {
+		r := startCommand(command, dir)
+		if m.Output {
+			pushView(&outputView{run: r, text: newScrollText(true)})
+		} else {
+			backgroundRuns = append(backgroundRuns, backgroundRun{m.Label, r})
+			status = fmt.Sprintf("Running %s...", m.Label)
+		}
+	}
+	if m.Confirm {
+		pushView(&confirmView{Prompt: fmt.Sprintf("Run %s? %s", m.Label, command), OnYes: run})
+	} else {
+		run()
+	}
+}
+
+// backgroundRun is a command of the user menu that runs without
+// showing its output
+type backgroundRun struct {
+	Label string
+	run   *commandRun
+}
+
+var backgroundRuns []backgroundRun
+
+// processBackgroundRuns tells how the background commands that ended
+// since the last call went, and refreshes the panels after them
+func processBackgroundRuns() {
+	running := backgroundRuns[:0]
+	for _, b := range backgroundRuns {
+		if b.run.Running() {
+			running = append(running, b)
+		} else if b.run.Err() != nil {
+			status = fmt.Sprintf("%s failed: %s, press O to see its output", b.Label, b.run.Err())
+		} else {
+			status = fmt.Sprintf("%s done", b.Label)
+		}
+	}
+	if len(running) < len(backgroundRuns) {
+		ap.Refresh()
+		op.Refresh()
+	}
+	backgroundRuns = running
+}
+
+// ------------------
+
+// userMenuView shows the entries of the user menu available for the
+// active panel
+type userMenuView struct {
+	entries []*menuEntry
+	cursor  int
+}
+
+func showUserMenu() {
+	if len(userMenu) == 0 {
+		status = "The user menu is empty, add commands to UserMenu in the config file"
+		return
+	}
+	if !requireFolder(ap) {
+		return
+	}
+	v := &userMenuView{}
+	for i := range userMenu {
+		if userMenu[i].Available() {
+			v.entries = append(v.entries, &userMenu[i])
+		}
+	}
+	if len(v.entries) == 0 {
+		status = "No commands of the user menu apply here"
+		return
+	}
+	pushView(v)
+}
+
+func (v *userMenuView) Render(w, h int) {
+	bw := 20
+	for _, m := range v.entries {
+		if n := runewidth.StringWidth(m.Label) + 8; n > bw {
+			bw = n
+		}
+	}
+	if bw > w {
+		bw = w
+	}
+	bh := len(v.entries) + 2
+	if bh > h-2 {
+		bh = h - 2
+	}
+	x, y := (w-bw)/2, (h-2-bh)/2
+	drawBox(x, y, bw, bh, "User menu")
+	top := 0
+	if v.cursor >= bh-2 {
+		top = v.cursor - (bh - 2) + 1
+	}
+	for i := 0; i < bh-2 && top+i < len(v.entries); i++ {
+		m := v.entries[top+i]
+		fg, bg := termbox.ColorDefault, termbox.ColorDefault
+		if top+i == v.cursor {
+			fg, bg = termbox.ColorBlack, termbox.ColorGreen
+		}
+		fill(x, y+1+i, bw, 1, termbox.Cell{Ch: ' ', Bg: bg})
+		tbprint(x+2, y+1+i, termbox.ColorYellow|termbox.AttrBold, bg, m.Key)
+		tbprintw(x+5, y+1+i, bw-6, fg, bg, m.Label)
+	}
+}
+
+func (v *userMenuView) HandleKey(ev termbox.Event) bool {
+	switch {
+	case ev.Key == termbox.KeyEsc || ev.Key == termbox.KeyF2:
+		return false
+	case ev.Key == termbox.KeyArrowUp:
+		if v.cursor > 0 {
+			v.cursor--
+		}
+	case ev.Key == termbox.KeyArrowDown:
+		if v.cursor < len(v.entries)-1 {
+			v.cursor++
+		}
+	case ev.Key == termbox.KeyHome:
+		v.cursor = 0
+	case ev.Key == termbox.KeyEnd:
+		v.cursor = len(v.entries) - 1
+	case ev.Key == termbox.KeyEnter:
+		v.entries[v.cursor].Run()
+		return false
+	case ev.Ch != 0:
+		for _, m := range v.entries {
+			if r, _ := utf8.DecodeRuneInString(m.Key); r == ev.Ch {
+				m.Run()
+				return false
+			}
+		}
+	}
+	return true
+}
+
+func (v *userMenuView) Help() string {
+	return "[ESC,F2 close] [ARROWS nav] [ENTER or key Run]"
+}
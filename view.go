@@ -0,0 +1,131 @@
+// Copyright 2017 Javier Arevalo <jare@iguanademos.com>
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+// http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Views drawn on top of the panels, and waking up the main loop
+// from other goroutines
+
+package main
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/mattn/go-runewidth"
+	"github.com/nsf/termbox-go"
+)
+
+// View is a screen that is drawn over the panels and takes over
+// the keyboard while it's open, like the jobs list or a dialog
+type View interface {
+	// Render draws the view given the size of the screen
+	Render(w, h int)
+	// HandleKey processes a key event, returning false to close the view
+	HandleKey(ev termbox.Event) bool
+	// Help returns the key help shown in the status line
+	Help() string
+}
+
+// StatusLineView is a View that draws the status line itself instead
+// of its help, eg to edit text there while the panels stay visible
+type StatusLineView interface {
+	View
+	// RenderStatus draws the status line at row y
+	RenderStatus(y, w int)
+}
+
+var views []View
+
+func pushView(v View) {
+	views = append(views, v)
+}
+
+// closeView removes a view from the stack, wherever it is
+func closeView(v View) {
+	for i := range views {
+		if views[i] == v {
+			views = append(views[:i], views[i+1:]...)
+			return
+		}
+	}
+}
+
+func topView() View {
+	if len(views) == 0 {
+		return nil
+	}
+	return views[len(views)-1]
+}
+
+// drawBox clears an area of the screen and draws a title line at its top
+func drawBox(x, y, w, h int, title string) {
+	fill(x, y, w, h, termbox.Cell{Ch: ' '})
+	fill(x, y, w, 1, termbox.Cell{Ch: ' ', Bg: termbox.ColorRed})
+	tbprintw(x+1, y, w-2, termbox.ColorWhite|termbox.AttrBold, termbox.ColorRed, title)
+}
+
+// confirmView asks a yes/no question in a popup
+type confirmView struct {
+	Prompt string
+	OnYes  func()
+	// If set, only this key confirms, instead of y or Y
+	Key rune
+}
+
+func (v *confirmView) Render(w, h int) {
+	bw := runewidth.StringWidth(v.Prompt) + 4
+	if bw > w {
+		bw = w
+	}
+	x, y := (w-bw)/2, h/2-2
+	drawBox(x, y, bw, 3, "Confirm")
+	tbprintw(x+2, y+1, bw-4, termbox.ColorWhite|termbox.AttrBold, termbox.ColorDefault, v.Prompt)
+}
+
+func (v *confirmView) HandleKey(ev termbox.Event) bool {
+	if (v.Key == 0 && (ev.Ch == 'y' || ev.Ch == 'Y')) || (v.Key != 0 && ev.Ch == v.Key) {
+		v.OnYes()
+	}
+	return false
+}
+
+func (v *confirmView) Help() string {
+	if v.Key != 0 {
+		return fmt.Sprintf("[%c Yes] [any other key No]", v.Key)
+	}
+	return "[y Yes] [any other key No]"
+}
+
+// ------------------
+
+var wakeup = make(chan struct{}, 1)
+
+// notifyUI asks the main loop to process background results and redraw.
+// Can be called from any goroutine, and never blocks: calls that come
+// while a wakeup is already pending are merged into it
+func notifyUI() {
+	select {
+	case wakeup <- struct{}{}:
+	default:
+	}
+}
+
+// uiNotifier turns wakeups into termbox interrupts. termbox.Interrupt
+// blocks until PollEvent picks it up, so it can't be called directly
+// from workers. Redraws are limited to a reasonable rate.
+func uiNotifier() {
+	for range wakeup {
+		termbox.Interrupt()
+		time.Sleep(time.Second / 20)
+	}
+}
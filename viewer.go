@@ -0,0 +1,934 @@
+// Copyright 2017 Javier Arevalo <jare@iguanademos.com>
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+// http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Full screen viewer for text files
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"github.com/mattn/go-runewidth"
+	"github.com/nsf/termbox-go"
+	"golang.org/x/text/unicode/norm"
+)
+
+const viewerTabWidth = 8
+
+// Longer lines are split, as if they had a line break every this many bytes
+const maxViewerLine = 64 * 1024
+
+// viewCell is a character of a line as it is shown
+type viewCell struct {
+	ch    rune
+	col   int
+	width int
+	// Position of the character in the line
+	off int
+	// Control characters and invalid UTF-8 are shown differently
+	special bool
+}
+
+// layoutLine places the characters of a line in columns, expanding
+// tabs and showing control characters as ^X. The line is normalized
+// to NFC first, so letters followed by combining marks are shown as the
+// precomposed letter when there is one
+func layoutLine(line []byte) []viewCell {
+	cells := make([]viewCell, 0, len(line))
+	col := 0
+	var seg []byte
+	for off := 0; off < len(line); {
+		// Take a character with its combining marks, which all get the
+		// position of its start in the line
+		_, size := utf8.DecodeRune(line[off:])
+		end := len(line)
+		if n := norm.NFC.FirstBoundary(line[off+size:]); n >= 0 {
+			end = off + size + n
+		}
+		seg = norm.NFC.Append(seg[:0], line[off:end]...)
+		for i := 0; i < len(seg); {
+			r, size := utf8.DecodeRune(seg[i:])
+			switch {
+			case r == '\t':
+				w := viewerTabWidth - col%viewerTabWidth
+				cells = append(cells, viewCell{' ', col, w, off, false})
+				col += w
+			case r == utf8.RuneError && size <= 1:
+				cells = append(cells, viewCell{'?', col, 1, off, true})
+				col++
+			case r < 0x20 || r == 0x7f:
+				cells = append(cells, viewCell{'^', col, 1, off, true}, viewCell{rune(r ^ 0x40), col + 1, 1, off, true})
+				col += 2
+			default:
+				// Zero width runes like combining marks without a
+				// precomposed form can't be drawn on their own cell,
+				// and don't move the following ones
+				if w := runewidth.RuneWidth(r); w > 0 {
+					cells = append(cells, viewCell{r, col, w, off, false})
+					col += w
+				}
+			}
+			i += size
+		}
+		off = end
+	}
+	return cells
+}
+
+// wrapCells splits the cells of a line in rows of the given width
+func wrapCells(cells []viewCell, w int) [][]viewCell {
+	var rows [][]viewCell
+	start, rowCol := 0, 0
+	for i, c := range cells {
+		if c.col+c.width-rowCol > w && i > start {
+			rows = append(rows, cells[start:i])
+			start, rowCol = i, c.col
+		}
+	}
+	return append(rows, cells[start:])
+}
+
+// ------------------
+
+// viewerSearch looks for text in the file in the background
+type viewerSearch struct {
+	ctx    context.Context
+	cancel context.CancelFunc
+	mu     sync.Mutex
+	done   bool
+	found  int64
+}
+
+// searchFile finds the first occurrence of text at or after from, or the
+// last one before from if backward. Returns -1 if there's none
+func searchFile(ctx context.Context, f *pagedFile, text []byte, fold bool, from int64, backward bool) int64 {
+	const chunkSize = 1024 * 1024
+	if len(text) == 0 {
+		return -1
+	}
+	overlap := int64(len(text) - 1)
+	buf := make([]byte, chunkSize+overlap)
+	size := f.Size()
+	if backward {
+		// Any match in [start, from+overlap) starts before from
+		end := from + overlap
+		if end > size {
+			end = size
+		}
+		for end > 0 && ctx.Err() == nil {
+			start := end - int64(len(buf))
+			if start < 0 {
+				start = 0
+			}
+			n, _ := f.readDirect(buf[:end-start], start)
+			data := buf[:n]
+			if fold {
+				data = lowerASCII(data)
+			}
+			if i := bytes.LastIndex(data, text); i >= 0 {
+				return start + int64(i)
+			}
+			if start == 0 {
+				break
+			}
+			end = start + overlap
+		}
+		return -1
+	}
+	for pos := from; pos < size && ctx.Err() == nil; pos += chunkSize {
+		n, _ := f.readDirect(buf, pos)
+		data := buf[:n]
+		if fold {
+			data = lowerASCII(data)
+		}
+		if i := bytes.Index(data, text); i >= 0 {
+			return pos + int64(i)
+		}
+	}
+	return -1
+}
+
+// lowerASCII lowers the case of ASCII letters in place, keeping the
+// positions of everything else
+func lowerASCII(data []byte) []byte {
+	for i, c := range data {
+		if c >= 'A' && c <= 'Z' {
+			data[i] = c + 'a' - 'A'
+		}
+	}
+	return data
+}
+
+// ------------------
+
+const (
+	viewerEditNone = iota
+	viewerEditSearch
+	viewerEditLine
+	viewerEditHex
+)
+
+// viewer shows a file, reading only the parts that are shown
+type viewer struct {
+	path  string
+	file  *pagedFile
+	index *lineIndex
+	// Offset of the first line shown
+	top int64
+	// Rows of the first line that are skipped when wrapping
+	topRow int
+	// Columns skipped when not wrapping
+	left int
+	wrap bool
+	// Show a hex dump instead of text, in groups of hexGroup bytes
+	hex      bool
+	hexGroup int
+	// Size of the text area in the last render
+	w, h int
+	// Offset after the last line shown
+	bottom int64
+
+	editor  *LineEditor
+	editing int
+	// The text searched, lowered if the search ignores case
+	searchText []byte
+	searchFold bool
+	search     *viewerSearch
+	// Where the search started, to return there if cancelled
+	searchStart int64
+	// The hex search typed is not valid
+	badHex bool
+	// The search being typed found nothing
+	notFound bool
+	// The match found, -1 if none
+	match int64
+	// Line to go to once the lines are counted that far
+	pendingLine int64
+
+	// Highlighting, and the state of the highlighter at the start of
+	// the lines seen
+	syntax    *syntax
+	highlight bool
+	synStates map[int64]int
+
+	// Follow mode keeps showing the end of the file as it grows
+	following  bool
+	stopFollow context.CancelFunc
+}
+
+func newViewer(path string) (*viewer, error) {
+	f, err := openPagedFile(path)
+	if err != nil {
+		return nil, err
+	}
+	v := &viewer{path: path, file: f, index: newLineIndex(f), wrap: true, hexGroup: 1, match: -1}
+	v.hex = detectBinary(f)
+	if !v.hex {
+		// Only the start of the first line is needed for a #! line
+		head := make([]byte, 256)
+		n, _ := f.ReadAt(head, 0)
+		first := head[:n]
+		if i := bytes.IndexByte(first, '\n'); i >= 0 {
+			first = first[:i]
+		}
+		v.syntax = detectSyntax(path, first)
+	}
+	v.highlight = v.syntax != nil
+	v.synStates = make(map[int64]int)
+	return v, nil
+}
+
+// openViewer shows a file in the viewer
+func openViewer(path string) {
+	v, err := newViewer(path)
+	if err != nil {
+		status = err.Error()
+		return
+	}
+	pushView(v)
+}
+
+// Close releases the file
+func (v *viewer) Close() {
+	v.setFollow(false)
+	v.cancelSearch()
+	v.index.Close()
+	v.file.Close()
+}
+
+// readLine returns the line starting at off, without its line break,
+// and the offset of the next line. A line that reaches maxViewerLine
+// bytes ends there, and the rest is the next line
+func (v *viewer) readLine(off int64) ([]byte, int64) {
+	var line []byte
+	chunk := make([]byte, 4096)
+	for len(line) < maxViewerLine {
+		if rest := maxViewerLine - len(line); rest < len(chunk) {
+			chunk = chunk[:rest]
+		}
+		n, err := v.file.ReadAt(chunk, off)
+		if i := bytes.IndexByte(chunk[:n], '\n'); i >= 0 {
+			line = append(line, chunk[:i]...)
+			return bytes.TrimSuffix(line, []byte{'\r'}), off + int64(i) + 1
+		}
+		line = append(line, chunk[:n]...)
+		off += int64(n)
+		if err != nil || n == 0 {
+			return bytes.TrimSuffix(line, []byte{'\r'}), off
+		}
+	}
+	return line, off
+}
+
+// lineStart returns where the line containing off starts. It looks back
+// at most maxViewerLine bytes; without a line break there, the line is
+// split like readLine does, counting back from off
+func (v *viewer) lineStart(off int64) int64 {
+	limit := off - maxViewerLine + 1
+	if limit < 0 {
+		limit = 0
+	}
+	chunk := make([]byte, 4096)
+	for off > limit {
+		start := off - int64(len(chunk))
+		if start < limit {
+			start = limit
+		}
+		n, _ := v.file.ReadAt(chunk[:off-start], start)
+		if i := bytes.LastIndexByte(chunk[:n], '\n'); i >= 0 {
+			return start + int64(i) + 1
+		}
+		off = start
+	}
+	return limit
+}
+
+// rows returns how the line is split in rows on the screen
+func (v *viewer) rows(line []byte) [][]viewCell {
+	cells := layoutLine(line)
+	if !v.wrap || v.w <= 0 {
+		return [][]viewCell{cells}
+	}
+	return wrapCells(cells, v.w)
+}
+
+// scrollDown moves the view n rows down, stopping when the end
+// of the file is shown
+func (v *viewer) scrollDown(n int) {
+	if v.hex {
+		v.hexScroll(n)
+		return
+	}
+	endTop, endRow := v.endPosition()
+	for ; n > 0; n-- {
+		if v.top > endTop || (v.top == endTop && v.topRow >= endRow) {
+			return
+		}
+		line, next := v.readLine(v.top)
+		if v.topRow+1 < len(v.rows(line)) {
+			v.topRow++
+		} else {
+			v.top, v.topRow = next, 0
+		}
+	}
+}
+
+// endPosition returns the top position that shows the end of the file
+func (v *viewer) endPosition() (int64, int) {
+	top, topRow := v.top, v.topRow
+	v.goToEnd()
+	endTop, endRow := v.top, v.topRow
+	v.top, v.topRow = top, topRow
+	return endTop, endRow
+}
+
+// scrollUp moves the view n rows up
+func (v *viewer) scrollUp(n int) {
+	if v.hex {
+		v.hexScroll(-n)
+		return
+	}
+	for ; n > 0; n-- {
+		if v.topRow > 0 {
+			v.topRow--
+		} else if v.top > 0 {
+			v.top = v.lineStart(v.top - 1)
+			line, _ := v.readLine(v.top)
+			v.topRow = len(v.rows(line)) - 1
+		} else {
+			return
+		}
+	}
+}
+
+func (v *viewer) goToEnd() {
+	if v.hex {
+		v.top = v.hexEnd()
+		return
+	}
+	v.top, v.topRow = v.file.Size(), 0
+	v.scrollUp(v.h)
+}
+
+// goToLine shows line n (from 1) at the top
+func (v *viewer) goToLine(n int64) {
+	if n < 1 {
+		n = 1
+	}
+	off := v.index.OffsetOf(n - 1)
+	if off < 0 {
+		// Render tries again as the counting goes on
+		v.pendingLine = n
+		return
+	}
+	v.pendingLine = 0
+	v.top, v.topRow = v.lineStart(off), 0
+	if v.top >= v.file.Size() && v.top > 0 {
+		v.goToEnd()
+	}
+}
+
+// showOffset scrolls to show the line containing off, with some
+// lines above it for context, and the column it's at
+func (v *viewer) showOffset(off int64) {
+	if v.hex {
+		v.hexShowOffset(off)
+		return
+	}
+	v.top, v.topRow = v.lineStart(off), 0
+	line, _ := v.readLine(v.top)
+	col := 0
+	for _, c := range layoutLine(line) {
+		if int64(c.off) >= off-v.top {
+			break
+		}
+		col = c.col + c.width
+	}
+	if v.wrap {
+		for i, row := range v.rows(line) {
+			if len(row) > 0 && row[0].col <= col {
+				v.topRow = i
+			}
+		}
+	} else if col < v.left || col >= v.left+v.w {
+		v.left = col - v.w/2
+		if v.left < 0 {
+			v.left = 0
+		}
+	}
+	v.scrollUp(v.h / 3)
+}
+
+// ------------------
+
+// startSearch searches the text from the given offset in the background
+func (v *viewer) startSearch(from int64, backward bool) {
+	v.cancelSearch()
+	v.notFound = false
+	if len(v.searchText) == 0 {
+		v.match = -1
+		return
+	}
+	s := &viewerSearch{found: -1}
+	s.ctx, s.cancel = context.WithCancel(context.Background())
+	v.search = s
+	text, fold := v.searchText, v.searchFold
+	go func() {
+		found := searchFile(s.ctx, v.file, text, fold, from, backward)
+		s.mu.Lock()
+		s.done, s.found = true, found
+		s.mu.Unlock()
+		notifyUI()
+	}()
+}
+
+func (v *viewer) cancelSearch() {
+	if v.search != nil {
+		v.search.cancel()
+		v.search = nil
+	}
+}
+
+// checkSearch shows the result of the background search when it ends
+func (v *viewer) checkSearch() {
+	if v.search == nil {
+		return
+	}
+	v.search.mu.Lock()
+	done, found := v.search.done, v.search.found
+	v.search.mu.Unlock()
+	if !done {
+		return
+	}
+	v.search = nil
+	if found < 0 {
+		if v.editing != viewerEditNone {
+			v.notFound = true
+		} else {
+			status = "Text not found"
+		}
+		v.match = -1
+		return
+	}
+	v.match = found
+	v.setFollow(false)
+	v.showOffset(found)
+}
+
+// setSearchText changes the text to search. It ignores case
+// unless it has uppercase letters
+func (v *viewer) setSearchText(text string) {
+	v.searchText = []byte(text)
+	v.searchFold = strings.ToLower(text) == text
+	if v.searchFold {
+		v.searchText = lowerASCII(v.searchText)
+	}
+}
+
+// setSearchHex changes the bytes to search, written in hex
+func (v *viewer) setSearchHex(text string) {
+	data, err := parseHexBytes(text)
+	v.badHex = err != nil
+	if err != nil {
+		data = nil
+	}
+	v.searchText, v.searchFold = data, false
+}
+
+// highlights marks the bytes of a line that match the search
+func (v *viewer) highlights(line []byte) []bool {
+	if len(v.searchText) == 0 {
+		return nil
+	}
+	data := line
+	if v.searchFold {
+		data = lowerASCII(append([]byte(nil), line...))
+	}
+	var marks []bool
+	for start := 0; ; {
+		i := bytes.Index(data[start:], v.searchText)
+		if i < 0 {
+			break
+		}
+		if marks == nil {
+			marks = make([]bool, len(line))
+		}
+		for k := start + i; k < start+i+len(v.searchText); k++ {
+			marks[k] = true
+		}
+		start += i + len(v.searchText)
+	}
+	return marks
+}
+
+// ------------------
+
+// How often the file is checked for changes when following it
+const followInterval = 500 * time.Millisecond
+
+// setFollow starts or stops following the end of the file
+func (v *viewer) setFollow(on bool) {
+	if on == v.following {
+		return
+	}
+	v.following = on
+	if !on {
+		v.stopFollow()
+		return
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	v.stopFollow = cancel
+	go func() {
+		t := time.NewTicker(followInterval)
+		defer t.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-t.C:
+				// Render checks the file
+				notifyUI()
+			}
+		}
+	}()
+	v.poll()
+}
+
+// poll checks if the file grew, was truncated or was replaced by a new
+// one, and shows its end
+func (v *viewer) poll() {
+	if v.file.Replaced(v.path) {
+		f, err := openPagedFile(v.path)
+		if err == nil {
+			v.cancelSearch()
+			v.index.Close()
+			v.file.Close()
+			v.file, v.index = f, newLineIndex(f)
+			v.match = -1
+			v.synStates = make(map[int64]int)
+			status = "The file was replaced, showing the new one"
+		}
+	} else if size, old, err := v.file.Refresh(); err == nil && size < old {
+		v.cancelSearch()
+		v.index.Close()
+		v.index = newLineIndex(v.file)
+		v.match = -1
+		v.synStates = make(map[int64]int)
+		status = "The file was truncated"
+	} else if size > old {
+		v.index.Continue()
+	}
+	v.goToEnd()
+}
+
+// atEnd returns whether the end of the file is shown
+func (v *viewer) atEnd() bool {
+	top, topRow := v.top, v.topRow
+	v.goToEnd()
+	end := v.top == top && v.topRow == topRow
+	v.top, v.topRow = top, topRow
+	return end
+}
+
+// ------------------
+
+// Lines highlighted before the screen to find the state of the
+// highlighter, when not known
+const maxSyntaxBacktrack = 200
+
+// Known states are forgotten when there are more than this
+const maxSyntaxStates = 100000
+
+// syntaxState returns the state of the highlighter at the start of the
+// line at off, highlighting the lines before it if it isn't known
+func (v *viewer) syntaxState(off int64) int {
+	if state, ok := v.synStates[off]; ok || off == 0 {
+		return state
+	}
+	if len(v.synStates) > maxSyntaxStates {
+		v.synStates = make(map[int64]int)
+	}
+	// Go back to a line with a known state, or start from a normal
+	// state after a while
+	start := off
+	for i := 0; i < maxSyntaxBacktrack && start > 0; i++ {
+		start = v.lineStart(start - 1)
+		if _, ok := v.synStates[start]; ok {
+			break
+		}
+	}
+	state := v.synStates[start]
+	for pos := start; pos < off; {
+		line, next := v.readLine(pos)
+		_, state = v.syntax.highlight(v.syntax, line, state)
+		pos = next
+		v.synStates[pos] = state
+	}
+	return state
+}
+
+func (v *viewer) Render(w, h int) {
+	v.w, v.h = w, h-2
+	v.checkSearch()
+	if v.following {
+		v.poll()
+	}
+	if v.pendingLine > 0 {
+		v.goToLine(v.pendingLine)
+	}
+	if v.hex {
+		drawBox(0, 0, w, h-1, v.path+" [hex]")
+		v.renderHex(w, h)
+		return
+	}
+	title := v.path
+	if v.highlight {
+		title += " [" + v.syntax.name + "]"
+	}
+	drawBox(0, 0, w, h-1, title)
+	size := v.file.Size()
+	off, skip := v.top, v.topRow
+	state := 0
+	if v.highlight {
+		state = v.syntaxState(off)
+	}
+	y := 1
+	for y < h-1 && off < size {
+		line, next := v.readLine(off)
+		marks := v.highlights(line)
+		var classes []syntaxClass
+		if v.highlight {
+			classes, state = v.syntax.highlight(v.syntax, line, state)
+			v.synStates[next] = state
+		}
+		rows := v.rows(line)
+		for r := skip; r < len(rows) && y < h-1; r++ {
+			x0 := 0
+			if len(rows[r]) > 0 {
+				x0 = rows[r][0].col
+			}
+			if !v.wrap {
+				x0 = v.left
+			}
+			for _, c := range rows[r] {
+				x := c.col - x0
+				if x < 0 {
+					continue
+				}
+				if x+c.width > w {
+					break
+				}
+				fg, bg := termbox.ColorDefault, termbox.ColorDefault
+				if c.special {
+					fg = termbox.ColorCyan
+				} else if classes != nil && classes[c.off] != synNone {
+					fg = syntaxColors[classes[c.off]]
+				}
+				if marks != nil && marks[c.off] {
+					fg, bg = termbox.ColorBlack, termbox.ColorYellow
+					if off+int64(c.off) >= v.match && off+int64(c.off) < v.match+int64(len(v.searchText)) {
+						bg = termbox.ColorGreen
+					}
+				}
+				termbox.SetCell(x, y, c.ch, fg, bg)
+				for k := 1; k < c.width && c.ch == ' '; k++ {
+					// Expanded tabs
+					termbox.SetCell(x+k, y, ' ', fg, bg)
+				}
+			}
+			y++
+		}
+		skip = 0
+		off = next
+	}
+	v.bottom = off
+}
+
+// position describes where the view is in the file
+func (v *viewer) position() string {
+	if v.hex {
+		return v.hexPosition()
+	}
+	size := v.file.Size()
+	percent := int64(100)
+	if size > 0 {
+		percent = v.bottom * 100 / size
+	}
+	line := "?"
+	if n := v.index.LineOf(v.top); n >= 0 {
+		line = strconv.FormatInt(n+1, 10)
+	}
+	total, done := v.index.Lines()
+	more := ""
+	if !done {
+		more = "+"
+	}
+	col := ""
+	if !v.wrap && v.left > 0 {
+		col = fmt.Sprintf(" col %d", v.left+1)
+	}
+	return fmt.Sprintf("line %s/%d%s%s %d%%", line, total, more, col, percent)
+}
+
+func (v *viewer) RenderStatus(y, w int) {
+	switch v.editing {
+	case viewerEditSearch, viewerEditLine, viewerEditHex:
+		label := "Search: "
+		if v.editing == viewerEditLine && v.hex {
+			label = "Go to offset (0x for hex, or N%): "
+		} else if v.editing == viewerEditLine {
+			label = "Go to line (or N%): "
+		} else if v.editing == viewerEditHex {
+			label = "Search hex bytes: "
+		}
+		x := tbprint(0, y, termbox.ColorYellow|termbox.AttrBold, termbox.ColorDefault, label)
+		hint := ""
+		if v.editing == viewerEditHex && v.badHex {
+			hint = " invalid hex"
+		} else if v.editing != viewerEditLine && v.notFound {
+			hint = " not found"
+		}
+		ew := w - x - len(hint)
+		tbprint(x+ew, y, termbox.ColorRed, termbox.ColorDefault, hint)
+		v.editor.Render(x, y, ew, termbox.ColorWhite, termbox.ColorBlue, true)
+	default:
+		pos := v.position()
+		if v.following {
+			pos += " following"
+		}
+		x := tbprintw(0, y, w, termbox.ColorCyan, termbox.ColorDefault, pos)
+		tbprintw(x+2, y, w-x-2, termbox.ColorDefault, termbox.ColorDefault, v.Help())
+	}
+}
+
+// handleEditKey processes keys while typing a search or line number
+func (v *viewer) handleEditKey(ev termbox.Event) {
+	switch ev.Key {
+	case termbox.KeyEsc:
+		if v.editing == viewerEditSearch || v.editing == viewerEditHex {
+			v.cancelSearch()
+			v.setSearchText("")
+			v.match = -1
+			v.top, v.topRow = v.searchStart, 0
+		}
+		v.editing = viewerEditNone
+		return
+	case termbox.KeyEnter:
+		if v.editing == viewerEditLine && v.hex {
+			v.goToOffset(v.editor.Text())
+		} else if v.editing == viewerEditLine {
+			v.goToText(v.editor.Text())
+		}
+		v.editing = viewerEditNone
+		return
+	}
+	if !v.editor.HandleKey(ev) || v.editing == viewerEditLine {
+		return
+	}
+	// Incremental search from where it started
+	if v.editing == viewerEditHex {
+		v.setSearchHex(v.editor.Text())
+	} else {
+		v.setSearchText(v.editor.Text())
+	}
+	v.startSearch(v.searchStart, false)
+}
+
+// goToText goes to a line number or a percentage of the file
+func (v *viewer) goToText(text string) {
+	text = strings.TrimSpace(text)
+	if strings.HasSuffix(text, "%") {
+		p, err := strconv.ParseFloat(strings.TrimSuffix(text, "%"), 64)
+		if err != nil {
+			status = "Bad percentage " + text
+			return
+		}
+		v.top, v.topRow = v.lineStart(int64(float64(v.file.Size())*p/100)), 0
+		return
+	}
+	n, err := strconv.ParseInt(text, 10, 64)
+	if err != nil {
+		status = "Bad line number " + text
+		return
+	}
+	v.goToLine(n)
+}
+
+func (v *viewer) HandleKey(ev termbox.Event) bool {
+	if v.editing != viewerEditNone {
+		v.handleEditKey(ev)
+		return true
+	}
+	if ev.Ch == 'F' {
+		v.setFollow(!v.following)
+		return true
+	}
+	defer func() {
+		// Moving away from the end pauses following
+		if v.following && !v.atEnd() {
+			v.setFollow(false)
+			status = "Following paused, press F to resume"
+		}
+	}()
+	if ev.Key == termbox.KeyEsc || ev.Ch == 'q' || ev.Key == termbox.KeyF3 || ev.Key == termbox.KeyF10 {
+		v.Close()
+		return false
+	} else if ev.Key == termbox.KeyArrowUp || ev.Ch == 'k' {
+		v.scrollUp(1)
+	} else if ev.Key == termbox.KeyArrowDown || ev.Ch == 'j' || ev.Key == termbox.KeyEnter {
+		v.scrollDown(1)
+	} else if ev.Key == termbox.KeyPgup || ev.Ch == 'u' || ev.Ch == 'b' {
+		v.scrollUp(v.h - 1)
+	} else if ev.Key == termbox.KeyPgdn || ev.Ch == 'i' || ev.Key == termbox.KeySpace {
+		v.scrollDown(v.h - 1)
+	} else if ev.Key == termbox.KeyHome || ev.Ch == 'U' || ev.Ch == 'g' {
+		v.top, v.topRow = 0, 0
+	} else if ev.Key == termbox.KeyEnd || ev.Ch == 'I' || ev.Ch == 'G' {
+		v.goToEnd()
+	} else if ev.Ch == 's' {
+		if v.syntax == nil {
+			status = "No syntax highlighting for this file"
+		} else {
+			v.highlight = !v.highlight
+		}
+	} else if ev.Ch == 'x' {
+		v.setHex(!v.hex)
+	} else if ev.Ch == 'w' && v.hex {
+		for i, g := range hexGroupWidths {
+			if g == v.hexGroup {
+				v.hexGroup = hexGroupWidths[(i+1)%len(hexGroupWidths)]
+				break
+			}
+		}
+		v.hexAlign()
+	} else if v.hex && (ev.Key == termbox.KeyArrowLeft || ev.Ch == 'h' || ev.Key == termbox.KeyArrowRight || ev.Ch == 'l') {
+		// Rows always fit the screen
+	} else if ev.Key == termbox.KeyArrowLeft || ev.Ch == 'h' {
+		if !v.wrap && v.left > 0 {
+			v.left -= viewerTabWidth
+			if v.left < 0 {
+				v.left = 0
+			}
+		}
+	} else if ev.Key == termbox.KeyArrowRight || ev.Ch == 'l' {
+		if !v.wrap {
+			v.left += viewerTabWidth
+		}
+	} else if ev.Ch == 'w' {
+		v.wrap = !v.wrap
+		v.topRow, v.left = 0, 0
+	} else if ev.Ch == '/' || ev.Ch == '\\' {
+		v.editing = viewerEditSearch
+		if ev.Ch == '\\' {
+			v.editing = viewerEditHex
+			v.badHex = false
+		}
+		v.editor = NewLineEditor("")
+		v.searchStart = v.top
+	} else if ev.Ch == ':' {
+		v.editing = viewerEditLine
+		v.editor = NewLineEditor("")
+	} else if ev.Ch == 'n' || ev.Ch == 'N' {
+		if len(v.searchText) == 0 {
+			status = "Press / to search"
+		} else if ev.Ch == 'n' {
+			from := v.top
+			if v.match >= 0 {
+				from = v.match + 1
+			}
+			v.startSearch(from, false)
+		} else {
+			from := v.top
+			if v.match >= 0 {
+				from = v.match
+			}
+			v.startSearch(from, true)
+		}
+	}
+	return true
+}
+
+func (v *viewer) Help() string {
+	if v.hex {
+		return "[ESC,q close] [ARROWS scroll] [/ search text] [\\ search hex] [n/N next/prev] [: go to offset] [w group width] [x text] [F follow]"
+	}
+	return "[ESC,q close] [ARROWS scroll] [/ search] [\\ search hex] [n/N next/prev] [: go to line] [w wrap] [s syntax] [x hex] [F follow]"
+}